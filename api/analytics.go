@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"image-job-processor/internal/service"
+	"net/http"
+	"time"
+)
+
+// StoreAnalyticsHandler returns visit statistics per store over an optional
+// from/to date range
+func (s *Server) StoreAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+
+	if err != nil {
+		sendErrBack(err.Error(), w)
+		return
+	}
+
+	stats, err := s.analytics.StoreStats(r.Context(), from, to)
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	type StoreStats struct {
+		StoreID   string `json:"store_id"`
+		StoreName string `json:"store_name"`
+		AreaCode  string `json:"area_code"`
+		service.VisitStats
+	}
+
+	res := struct {
+		From   *time.Time   `json:"from,omitempty"`
+		To     *time.Time   `json:"to,omitempty"`
+		Stores []StoreStats `json:"stores"`
+	}{
+		From:   optionalTime(from),
+		To:     optionalTime(to),
+		Stores: make([]StoreStats, 0, len(stats)),
+	}
+
+	for _, stat := range stats {
+		ss := StoreStats{StoreID: stat.Key, VisitStats: stat}
+		ss.Stores = 0 // always one, not reported per store
+
+		if st, exists := s.stores.GetStore(stat.Key); exists {
+			ss.StoreName = st.Name
+			ss.AreaCode = st.AreaCode
+		}
+
+		res.Stores = append(res.Stores, ss)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// AreaAnalyticsHandler returns visit statistics per area code over an optional
+// from/to date range
+func (s *Server) AreaAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+
+	if err != nil {
+		sendErrBack(err.Error(), w)
+		return
+	}
+
+	stats, err := s.analytics.AreaStats(r.Context(), from, to)
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	type AreaStats struct {
+		AreaCode string `json:"area_code"`
+		service.VisitStats
+	}
+
+	res := struct {
+		From  *time.Time  `json:"from,omitempty"`
+		To    *time.Time  `json:"to,omitempty"`
+		Areas []AreaStats `json:"areas"`
+	}{
+		From:  optionalTime(from),
+		To:    optionalTime(to),
+		Areas: make([]AreaStats, 0, len(stats)),
+	}
+
+	for _, stat := range stats {
+		res.Areas = append(res.Areas, AreaStats{AreaCode: stat.Key, VisitStats: stat})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseDateRange reads the optional from and to query parameters, given either
+// as RFC3339 timestamps or as dates (2006-01-02). A date used as "to" includes the whole day.
+func parseDateRange(r *http.Request) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+
+	from, err := parseDate(query.Get("from"), false)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %v", err)
+	}
+
+	to, err := parseDate(query.Get("to"), true)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %v", err)
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+func parseDate(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("use an RFC3339 timestamp or a date like 2024-11-16")
+	}
+
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/service"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// APIKeyHeader carries the API key of a client, which may also be sent as
+// Authorization: Bearer <key>
+const APIKeyHeader = "X-API-Key"
+
+type apiKeyKey struct{}
+
+// AuthMiddleware authenticates every request but the probes and the metrics by
+// its API key when authentication is enabled, and attaches the key and a logger
+// carrying its owner to the request context
+func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled || isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		raw := requestAPIKey(r)
+		if raw == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendErrBackWithStatus("api key required", http.StatusUnauthorized, w)
+			return
+		}
+
+		key, err := s.apiKeys.FindAPIKeyByHash(r.Context(), service.HashAPIKey(raw))
+
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendErrBackWithStatus("invalid api key", http.StatusUnauthorized, w)
+			return
+		}
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Failed to look up api key", "error", err)
+			sendErrBackWithStatus("failed to check api key", http.StatusInternalServerError, w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyKey{}, key)
+		ctx = logger.NewContext(ctx, logger.FromContext(ctx).With("owner", key.Owner))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// APIKeyFromContext returns the key set by AuthMiddleware, nil when
+// authentication is disabled
+func APIKeyFromContext(ctx context.Context) *model.APIKey {
+	key, _ := ctx.Value(apiKeyKey{}).(*model.APIKey)
+	return key
+}
+
+// isPublicPath tells the endpoints served without an API key, for the
+// orchestrator and the metrics scraper
+func isPublicPath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics"
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(key)
+	}
+
+	return ""
+}
+
+// adminOnly rejects the requests not made with an admin key. Without
+// authentication nobody can be told to be an admin, every request is rejected.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := APIKeyFromContext(r.Context())
+		if key == nil {
+			sendErrBackWithStatus("admin endpoints are disabled, enable authentication to use them", http.StatusForbidden, w)
+			return
+		}
+		if !key.Admin {
+			sendErrBackWithStatus("admin api key required", http.StatusForbidden, w)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// canSeeOwner tells whether the caller may read the jobs of owner: admins and
+// the owner itself can, and everyone when authentication is disabled
+func canSeeOwner(ctx context.Context, owner string) bool {
+	key := APIKeyFromContext(ctx)
+	return key == nil || key.Admin || key.Owner == owner
+}
+
+// checkJobOwner returns mongo.ErrNoDocuments if the caller may not read the
+// job, so that the jobs of other clients look like they do not exist
+func (s *Server) checkJobOwner(ctx context.Context, id primitive.ObjectID) error {
+	if key := APIKeyFromContext(ctx); key == nil || key.Admin {
+		return nil
+	}
+
+	owner, err := s.jobs.GetOwnerByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if !canSeeOwner(ctx, owner) {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// ownerOf returns the owner of the jobs submitted by the caller, empty when
+// authentication is disabled
+func ownerOf(ctx context.Context) string {
+	if key := APIKeyFromContext(ctx); key != nil {
+		return key.Owner
+	}
+	return ""
+}
+
+// CreateAPIKeyHandler generates a key, which is only ever returned here
+func (s *Server) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Owner  string        `json:"owner"`
+		Name   string        `json:"name"`
+		Admin  bool          `json:"admin"`
+		Limits *model.Limits `json:"limits"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrBack("JSON decoding error", w)
+		return
+	}
+
+	req.Owner = strings.TrimSpace(req.Owner)
+
+	if req.Owner == "" {
+		sendErrBack("owner is required", w)
+		return
+	}
+
+	if err := validateLimits(req.Limits); err != nil {
+		sendErrBack(err.Error(), w)
+		return
+	}
+
+	raw, key, err := service.NewAPIKey(req.Owner, strings.TrimSpace(req.Name), req.Admin)
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	key.Limits = req.Limits
+
+	key.ID, err = s.apiKeys.InsertAPIKey(r.Context(), key)
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("Created api key", "key_id", key.ID.Hex(), "key_owner", key.Owner, "admin", key.Admin)
+
+	res := struct {
+		model.APIKey
+		Key string `json:"key"`
+	}{
+		APIKey: key,
+		Key:    raw,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// ListAPIKeysHandler returns every key, without the keys themselves
+func (s *Server) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.apiKeys.ListAPIKeys(r.Context())
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	res := struct {
+		Count int            `json:"count"`
+		Keys  []model.APIKey `json:"keys"`
+	}{
+		Count: len(keys),
+		Keys:  keys,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// SetAPIKeyLimitsHandler replaces the limits of a key, a null body restores the defaults
+func (s *Server) SetAPIKeyLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+
+	if err != nil {
+		sendErrBack("invalid key id", w)
+		return
+	}
+
+	var limits *model.Limits
+
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		sendErrBack("JSON decoding error", w)
+		return
+	}
+
+	if err := validateLimits(limits); err != nil {
+		sendErrBack(err.Error(), w)
+		return
+	}
+
+	if err := s.apiKeys.UpdateAPIKeyLimits(r.Context(), id, limits); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sendErrBackWithStatus("api key does not exist", http.StatusNotFound, w)
+			return
+		}
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("Changed api key limits", "key_id", id.Hex(), "limits", limits)
+
+	res := struct {
+		Limits *model.Limits `json:"limits"`
+	}{
+		Limits: limits,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// DeleteAPIKeyHandler revokes a key, requests made with it are rejected from then on
+func (s *Server) DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+
+	if err != nil {
+		sendErrBack("invalid key id", w)
+		return
+	}
+
+	if err := s.apiKeys.DeleteAPIKey(r.Context(), id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sendErrBackWithStatus("api key does not exist", http.StatusNotFound, w)
+			return
+		}
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("Revoked api key", "key_id", id.Hex())
+
+	w.WriteHeader(http.StatusNoContent)
+}
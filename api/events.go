@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"image-job-processor/internal/events"
+	"image-job-processor/internal/model"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const heartbeatInterval = 15 * time.Second
+
+// JobEventsStreamHandler streams the progress of a job as Server-Sent Events.
+// The stream ends after the terminal (completed/failed) event.
+func (s *Server) JobEventsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+
+	if err != nil {
+		sendErrBack("invalid jobid", w)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendErrBack("streaming is not supported", w)
+		return
+	}
+
+	// subscribe before reading the current state so no event is missed in between
+	ch, unsubscribe := s.broker.Subscribe(id.Hex())
+	defer unsubscribe()
+
+	sv, err := s.jobs.FindStoresVisitByID(r.Context(), id)
+
+	if err != nil || !canSeeOwner(r.Context(), sv.Owner) {
+		sendErrBack("jobid does not exist", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	eventID := 0
+
+	// the stored progress is only saved at the end of every visit, the last
+	// event carries the images processed since
+	snapshot := snapshotEvent(id, sv)
+	if latest, ok := s.broker.Latest(id.Hex()); ok && !snapshot.Terminal() && latest.ImagesProcessed > snapshot.ImagesProcessed {
+		snapshot = latest
+	}
+	writeEvent(w, &eventID, snapshot)
+	flusher.Flush()
+
+	if snapshot.Terminal() {
+		return
+	}
+
+	// events published before the snapshot was taken are still queued
+	processed := snapshot.ImagesProcessed
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			if !ev.Terminal() && ev.ImagesProcessed <= processed {
+				continue
+			}
+			processed = ev.ImagesProcessed
+
+			writeEvent(w, &eventID, ev)
+			flusher.Flush()
+			if ev.Terminal() {
+				return
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// snapshotEvent builds an event describing the state of the job as stored in db
+func snapshotEvent(id primitive.ObjectID, sv *model.StoresVisit) events.Event {
+	ev := events.Event{
+		Type:        events.TypeProgress,
+		JobID:       id.Hex(),
+		VisitsTotal: len(sv.Visits),
+	}
+
+	for i, v := range sv.Visits {
+		ev.ImagesTotal += len(v.ImageURLs)
+		ev.ImagesProcessed += len(v.ImageUUIDs)
+		if len(v.ImageUUIDs) > 0 {
+			ev.VisitIndex = i
+		}
+	}
+
+	switch sv.Status {
+	case "completed":
+		ev.Type = events.TypeCompleted
+	case "failed":
+		ev.Type = events.TypeFailed
+		ev.StoreID = sv.FailedStoreID
+		ev.Error = sv.Error
+	}
+
+	return ev
+}
+
+func writeEvent(w http.ResponseWriter, eventID *int, ev events.Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	*eventID++
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", *eventID, ev.Type, data)
+}
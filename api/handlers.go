@@ -1,17 +1,28 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"image-job-processor/internal/job"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/metrics"
 	"image-job-processor/internal/model"
 	"image-job-processor/internal/service"
+	"image-job-processor/internal/tracing"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func GetJobInfoHandler(w http.ResponseWriter, r *http.Request) {
+const maxIdempotencyKeyLen = 255
+
+func (s *Server) GetJobInfoHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
 	jobID := query.Get("jobid")
@@ -28,52 +39,247 @@ func GetJobInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	svs := service.NewStoresVisitService()
+	if err := s.checkJobOwner(r.Context(), id); err != nil {
+		sendErrBack("jobid does not exist", w)
+		return
+	}
 
-	status, errMssg, failedStoreID, err := svs.GetStatusAndErrorByID(id)
+	status, errMssg, failedStoreID, err := s.jobs.GetStatusAndErrorByID(r.Context(), id)
 
 	if err != nil {
 		sendErrBack("jobid does not exist", w)
-	} else {
-		if status == "completed" || status == "ongoing" {
-			res := struct {
-				Status string `json:"status"`
-				JobID  string `json:"job_id"`
-			}{
-				Status: status,
-				JobID:  jobID,
-			}
+		return
+	}
+
+	callbackURL, callbackAttempts, err := s.jobs.GetCallbackInfoByID(r.Context(), id)
+
+	if err != nil {
+		sendErrBack("jobid does not exist", w)
+		return
+	}
+
+	type ErrStruct struct {
+		StoreID string `json:"store_id"`
+		Error   string `json:"error"`
+	}
+
+	res := struct {
+		Status           string                  `json:"status"`
+		JobID            string                  `json:"job_id"`
+		Error            *ErrStruct              `json:"error,omitempty"`
+		CallbackURL      string                  `json:"callback_url,omitempty"`
+		CallbackAttempts []model.CallbackAttempt `json:"callback_attempts,omitempty"`
+	}{
+		Status:           status,
+		JobID:            jobID,
+		CallbackURL:      callbackURL,
+		CallbackAttempts: callbackAttempts,
+	}
+
+	if status != "completed" && status != "ongoing" {
+		res.Error = &ErrStruct{StoreID: failedStoreID, Error: errMssg}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetJobResultHandler returns a job together with the per visit results,
+// including the store details from the store master
+func (s *Server) GetJobResultHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+
+	if err != nil {
+		sendErrBack("invalid jobid", w)
+		return
+	}
+
+	sv, err := s.jobs.FindStoresVisitByID(r.Context(), id)
+
+	if err != nil || !canSeeOwner(r.Context(), sv.Owner) {
+		sendErrBackWithStatus("jobid does not exist", http.StatusNotFound, w)
+		return
+	}
+
+	type ImageResult struct {
+		URL       string `json:"url"`
+		ImageID   string `json:"image_id,omitempty"`
+		Perimeter int64  `json:"perimeter,omitempty"`
+	}
+
+	type VisitResult struct {
+		StoreID   string        `json:"store_id"`
+		StoreName string        `json:"store_name"`
+		AreaCode  string        `json:"area_code"`
+		VisitTime time.Time     `json:"visit_time"`
+		Images    []ImageResult `json:"images"`
+	}
+
+	type ErrStruct struct {
+		StoreID string `json:"store_id"`
+		Error   string `json:"error"`
+	}
+
+	res := struct {
+		JobID  string        `json:"job_id"`
+		Status string        `json:"status"`
+		Error  *ErrStruct    `json:"error,omitempty"`
+		Count  int           `json:"count"`
+		Visits []VisitResult `json:"visits"`
+	}{
+		JobID:  id.Hex(),
+		Status: sv.Status,
+		Count:  sv.Count,
+		Visits: make([]VisitResult, 0, len(sv.Visits)),
+	}
+
+	if sv.Status == "failed" {
+		res.Error = &ErrStruct{StoreID: sv.FailedStoreID, Error: sv.Error}
+	}
+
+	for _, v := range sv.Visits {
+		vr := VisitResult{
+			StoreID:   v.StoreID,
+			StoreName: v.StoreName,
+			AreaCode:  v.AreaCode,
+			VisitTime: v.VisitTime,
+			Images:    make([]ImageResult, len(v.ImageURLs)),
+		}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(res)
-		} else {
-			type ErrStruct struct {
-				StoreID string `json:"store_id"`
-				Error   string `json:"error"`
+		// visits not processed yet have no store details stored
+		if vr.StoreName == "" {
+			if st, exists := s.stores.GetStore(v.StoreID); exists {
+				vr.StoreName = st.Name
+				vr.AreaCode = st.AreaCode
 			}
+		}
 
-			res := struct {
-				Status string    `json:"status"`
-				JobID  string    `json:"job_id"`
-				Error  ErrStruct `json:"error"`
-			}{
-				Status: status,
-				JobID:  jobID,
-				Error:  ErrStruct{StoreID: failedStoreID, Error: errMssg},
+		for i, imgURL := range v.ImageURLs {
+			vr.Images[i].URL = imgURL
+			if i < len(v.ImageUUIDs) {
+				vr.Images[i].ImageID = v.ImageUUIDs[i]
+			}
+			if i < len(v.Perimeters) {
+				vr.Images[i].Perimeter = v.Perimeters[i]
 			}
+		}
+
+		res.Visits = append(res.Visits, vr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+const (
+	defaultJobsLimit = 100
+	maxJobsLimit     = 1000
+)
+
+// ListJobsHandler returns the jobs of the caller, newest first, optionally
+// filtered by status. Admins see every job and can filter them by owner.
+func (s *Server) ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := service.JobFilter{
+		Owner:  query.Get("owner"),
+		Status: query.Get("status"),
+		Limit:  defaultJobsLimit,
+	}
+
+	if key := APIKeyFromContext(r.Context()); key != nil && !key.Admin {
+		if filter.Owner != "" && filter.Owner != key.Owner {
+			sendErrBackWithStatus("can not list the jobs of another owner", http.StatusForbidden, w)
+			return
+		}
+		filter.Owner = key.Owner
+	}
+
+	switch filter.Status {
+	case "", "ongoing", "completed", "failed":
+	default:
+		sendErrBack("status must be ongoing, completed or failed", w)
+		return
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 || limit > maxJobsLimit {
+			sendErrBack(fmt.Sprintf("limit must be between 1 and %d", maxJobsLimit), w)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	storesVisits, err := s.jobs.FindStoresVisits(r.Context(), filter)
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	type ErrStruct struct {
+		StoreID string `json:"store_id"`
+		Error   string `json:"error"`
+	}
+
+	type JobResult struct {
+		JobID       string     `json:"job_id"`
+		Status      string     `json:"status"`
+		Owner       string     `json:"owner,omitempty"`
+		Count       int        `json:"count"`
+		SubmittedAt time.Time  `json:"submitted_at"`
+		Error       *ErrStruct `json:"error,omitempty"`
+		CallbackURL string     `json:"callback_url,omitempty"`
+	}
+
+	res := struct {
+		Count int         `json:"count"`
+		Jobs  []JobResult `json:"jobs"`
+	}{
+		Count: len(storesVisits),
+		Jobs:  make([]JobResult, 0, len(storesVisits)),
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(res)
+	for _, sv := range storesVisits {
+		jr := JobResult{
+			JobID:       sv.ID.Hex(),
+			Status:      sv.Status,
+			Owner:       sv.Owner,
+			Count:       sv.Count,
+			SubmittedAt: sv.ID.Timestamp().UTC(),
+			CallbackURL: sv.CallbackURL,
 		}
+
+		if sv.Status == "failed" {
+			jr.Error = &ErrStruct{StoreID: sv.FailedStoreID, Error: sv.Error}
+		}
+
+		res.Jobs = append(res.Jobs, jr)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
 }
 
-func SubmitJobHandler(w http.ResponseWriter, r *http.Request) {
-	var storesVisit model.StoresVisit
+func (s *Server) SubmitJobHandler(w http.ResponseWriter, r *http.Request) {
+	key := APIKeyFromContext(r.Context())
+	limits := s.limitsOf(key)
 
-	err := json.NewDecoder(r.Body).Decode(&storesVisit)
+	// rejected submissions count too, they load the service as well
+	if limits != nil {
+		if ok, retryAfter := s.rateLimiter.Allow(key.ID.Hex(), limits.RequestsPerMinute); !ok {
+			sendTooManyRequests(fmt.Sprintf("limit of %d submissions per minute reached", limits.RequestsPerMinute), retryAfter, w)
+			return
+		}
+	}
+
+	var req submitRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
 
 	if err != nil {
 		sendErrBack("JSON decoding error", w)
@@ -81,27 +287,129 @@ func SubmitJobHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// validate data
-	err = validateData(&storesVisit)
+	errs := validateData(&req, s.urlPolicy)
 
-	if err != nil {
-		sendErrBack(err.Error(), w)
+	if limits != nil {
+		errs = append(errs, validateImageCount(&req, limits.ImagesPerJob)...)
+	}
+
+	if req.CallbackURL != "" && !s.callbacksEnabled {
+		errs = append(errs, FieldError{
+			Path:    "callback_url",
+			Code:    codeCallbacksDisabled,
+			Message: "callbacks are disabled, the server has no webhook secret to sign them with",
+		})
+	}
+
+	var unknownStoreIDs []string
+
+	if s.validateStoreIDs {
+		sm, ok := s.loadedStoreManager(w)
+		if !ok {
+			return
+		}
+
+		var storeErrs []FieldError
+		storeErrs, unknownStoreIDs = validateStoreIDs(&req, sm)
+		errs = append(errs, storeErrs...)
+	}
+
+	if len(errs) > 0 {
+		sendValidationErrors(errs, unknownStoreIDs, w)
 		return
 	}
 
+	// a client hanging up must not leave the key reserved or the job half created
+	ctx := context.WithoutCancel(r.Context())
+
+	// honor Idempotency-Key so that retried requests do not create duplicate jobs
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	owner := ownerOf(r.Context())
+
+	if idempotencyKey != "" {
+		if len(idempotencyKey) > maxIdempotencyKeyLen {
+			sendErrBack(fmt.Sprintf("Idempotency-Key can not be longer than %d characters", maxIdempotencyKeyLen), w)
+			return
+		}
+
+		// clients choose their keys, they must not collide with those of other clients
+		if owner != "" {
+			idempotencyKey = owner + ":" + idempotencyKey
+		}
+
+		existing, err := s.keys.ReserveKey(ctx, idempotencyKey, requestHash(&req))
+
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Failed to reserve Idempotency-Key", "idempotency_key", idempotencyKey, "error", err)
+			sendErrBackWithStatus("failed to reserve Idempotency-Key, try again later", http.StatusServiceUnavailable, w)
+			return
+		}
+
+		if existing != nil {
+			replayIdempotentRequest(existing, requestHash(&req), w)
+			return
+		}
+	}
+
 	// insert in db with ongoing status
+	storesVisit := req.toModel()
 	storesVisit.Status = "ongoing"
+	storesVisit.Owner = owner
+	storesVisit.RequestID = RequestIDFromContext(r.Context())
+	storesVisit.TraceContext = tracing.Inject(r.Context())
+	// leased from the start, so that no other replica claims the job while it is queued
+	storesVisit.LeaseOwner = s.lease.Owner
+	storesVisit.LeaseExpiresAt = s.lease.Until()
+	if key != nil {
+		storesVisit.APIKeyID = key.ID
+	}
 
-	svs := service.NewStoresVisitService()
-
-	id, err := svs.InsertStoresVisit(storesVisit)
+	id, err := s.insertJob(ctx, key, limits, storesVisit, req.imageCount())
 
 	if err != nil {
-		sendErrBack(err.Error(), w)
+		if idempotencyKey != "" {
+			s.keys.ReleaseKey(ctx, idempotencyKey)
+		}
+
+		var qe *quotaError
+		if errors.As(err, &qe) {
+			logger.FromContext(r.Context()).Info("Rejected job over quota", "reason", qe.message)
+			sendTooManyRequests(qe.message, qe.retryAfter, w)
+			return
+		}
+
+		logger.FromContext(r.Context()).Error("Failed to store job", "error", err)
+		sendErrBackWithStatus("failed to store job, try again later", http.StatusServiceUnavailable, w)
+		return
+	}
+
+	metrics.JobsSubmitted.Inc()
+
+	log := logger.FromContext(r.Context()).With("job_id", id.Hex())
+
+	// queue the job for processing by the worker pool
+	if err := s.pool.Enqueue(id, storesVisit); err != nil {
+		log.Warn("Rejected job", "error", err)
+		metrics.JobsFailed.WithLabelValues(metrics.ReasonQueueFull).Inc()
+		s.jobs.UpdateStoresVisitStatus(ctx, id, "failed", err.Error(), "")
+		if idempotencyKey != "" {
+			s.keys.ReleaseKey(ctx, idempotencyKey)
+		}
+		sendErrBackWithStatus("too many jobs in progress, try again later", http.StatusServiceUnavailable, w)
 		return
 	}
 
-	// launch go routine for processing
-	go job.ProcessJob(id, storesVisit)
+	if idempotencyKey != "" {
+		if err := s.setJobID(ctx, idempotencyKey, id); err != nil {
+			// the job exists, releasing the key would let a retry create another
+			// one. Retries are told the request is still being processed until
+			// the reservation expires.
+			log.Error("Failed to store job id for Idempotency-Key", "idempotency_key", idempotencyKey, "expires_in", service.IdempotencyPendingTTL, "error", err)
+		}
+	}
+
+	log.Info("Accepted job", "visits", len(storesVisit.Visits))
 
 	// return job id as json
 	res := struct {
@@ -113,41 +421,74 @@ func SubmitJobHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func sendErrBack(err string, w http.ResponseWriter) {
-	type errRes struct {
-		Error string `json:"error"`
-	}
+// setJobIDAttempts is the number of times storing the job of an Idempotency-Key
+// is tried, waiting setJobIDBackoff and twice as long after every attempt
+const (
+	setJobIDAttempts = 3
+	setJobIDBackoff  = 100 * time.Millisecond
+)
 
-	res := errRes{Error: err}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
-	json.NewEncoder(w).Encode(res)
-}
+// setJobID stores the job created for the request that reserved key, retrying
+// a failed write
+func (s *Server) setJobID(ctx context.Context, key string, id primitive.ObjectID) error {
+	backoff := setJobIDBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := s.keys.SetJobID(ctx, key, id)
+		if err == nil || attempt >= setJobIDAttempts {
+			return err
+		}
 
-func validateData(sv *model.StoresVisit) error {
-	if sv.Count < 0 {
-		return fmt.Errorf("count can not be less than zero")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
 	}
+}
 
-	if len(sv.Visits) == 0 {
-		return fmt.Errorf("visits should not be emtpy")
+// replayIdempotentRequest answers a request whose Idempotency-Key has been seen before
+func replayIdempotentRequest(existing *service.IdempotencyRecord, hash string, w http.ResponseWriter) {
+	if existing.RequestHash != hash {
+		sendErrBackWithStatus("Idempotency-Key has already been used with a different request body", http.StatusConflict, w)
+		return
 	}
 
-	if len(sv.Visits) != sv.Count {
-		return fmt.Errorf("count != len(visits)")
+	if existing.JobID.IsZero() {
+		sendErrBackWithStatus("a request with this Idempotency-Key is still being processed", http.StatusConflict, w)
+		return
 	}
 
-	for _, v := range sv.Visits {
-		if v.StoreID == "" {
-			return fmt.Errorf("store_id is required")
-		}
-		if v.VisitTime == "" {
-			return fmt.Errorf("visit_time is required")
-		}
-		if len(v.ImageURLs) == 0 {
-			return fmt.Errorf("image_url cannot be empty for store_id: %s", v.StoreID)
-		}
+	res := struct {
+		JobID string `json:"job_id"`
+	}{JobID: existing.JobID.Hex()}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// requestHash fingerprints the decoded submission, so formatting differences
+// in the raw body do not matter
+func requestHash(req *submitRequest) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sendErrBack(err string, w http.ResponseWriter) {
+	sendErrBackWithStatus(err, http.StatusBadRequest, w)
+}
+
+func sendErrBackWithStatus(err string, status int, w http.ResponseWriter) {
+	type errRes struct {
+		Error string `json:"error"`
 	}
 
-	return nil
+	res := errRes{Error: err}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
 }
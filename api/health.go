@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds every readiness check, so a hung dependency can not
+// hold the probe past its own timeout
+const readinessTimeout = 2 * time.Second
+
+// Status of a dependency
+const (
+	dependencyUp   = "up"
+	dependencyDown = "down"
+)
+
+type dependencyStatus struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+type readinessResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+// readinessCheck returns the details to report about a dependency and an error if it is not usable
+type readinessCheck func(ctx context.Context) (map[string]any, error)
+
+func (s *Server) readinessChecks() map[string]readinessCheck {
+	return map[string]readinessCheck{
+		"mongo":        s.checkJobRepository,
+		"store_master": s.checkStoreMaster,
+		"storage":      s.checkStorage,
+		"job_pool":     s.checkJobPool,
+	}
+}
+
+// HealthzHandler reports that the process is up and serving requests. It does
+// not look at any dependency, see ReadyzHandler.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ReadyzHandler reports whether the server can take jobs: MongoDB answers, the
+// store master is loaded, images can be saved and the worker pool accepts jobs.
+// It answers 503 SERVICE UNAVAILABLE with the failing dependencies otherwise.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := s.readinessChecks()
+
+	res := readinessResponse{
+		Status:       "ready",
+		Dependencies: make(map[string]dependencyStatus, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			details, err := check(ctx)
+
+			status := dependencyStatus{Status: dependencyUp, Details: details}
+			if err != nil {
+				status.Status = dependencyDown
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			res.Dependencies[name] = status
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, status := range res.Dependencies {
+		if status.Status != dependencyUp {
+			res.Status = "not_ready"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) checkJobRepository(ctx context.Context) (map[string]any, error) {
+	start := time.Now()
+	err := s.jobs.Ping(ctx)
+	return map[string]any{"latency_ms": time.Since(start).Milliseconds()}, err
+}
+
+func (s *Server) checkStoreMaster(ctx context.Context) (map[string]any, error) {
+	// a failed reload keeps the stores loaded before, so the error only
+	// matters while nothing has been loaded
+	info := s.stores.Info()
+	details := map[string]any{
+		"source":  info.Source,
+		"version": info.Version,
+		"stores":  info.Loaded,
+	}
+
+	if info.Version == 0 {
+		err := s.stores.LastError()
+		if err == nil {
+			err = errors.New("store master has not been loaded")
+		}
+		return details, err
+	}
+
+	details["loaded_at"] = info.LoadedAt
+	return details, nil
+}
+
+func (s *Server) checkStorage(ctx context.Context) (map[string]any, error) {
+	return map[string]any{"dir": s.storage.Dir()}, s.storage.Check()
+}
+
+func (s *Server) checkJobPool(ctx context.Context) (map[string]any, error) {
+	details := map[string]any{
+		"workers":    s.pool.Workers(),
+		"queued":     s.pool.QueueDepth(),
+		"queue_size": s.pool.QueueSize(),
+	}
+	return details, s.pool.Accepting()
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"image-job-processor/internal/logger"
+	"net/http"
+	"strings"
+)
+
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// GetLogLevelHandler returns the lowest level currently logged
+func (s *Server) GetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	s.sendLogLevel(w)
+}
+
+// SetLogLevelHandler changes the lowest level logged until the next restart
+func (s *Server) SetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level string `json:"level"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrBack("JSON decoding error", w)
+		return
+	}
+
+	level, err := logger.ParseLevel(req.Level)
+	if err != nil {
+		sendErrBack("level must be debug, info, warn or error", w)
+		return
+	}
+
+	previous := s.log.Level()
+	s.log.SetLevel(level)
+
+	// logged at warn so the change is recorded whatever the new level is
+	logger.FromContext(r.Context()).Warn("Changed log level", "from", strings.ToLower(previous.String()), "to", strings.ToLower(level.String()))
+
+	s.sendLogLevel(w)
+}
+
+func (s *Server) sendLogLevel(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(logLevelResponse{Level: strings.ToLower(s.log.Level().String())})
+}
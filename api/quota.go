@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/quota"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// activeJobsRetryAfter is suggested to clients at their limit of active jobs,
+// when one of them finishes is not known
+const activeJobsRetryAfter = 10 * time.Second
+
+// limitsOf returns the limits of the submissions made with key, nil when they
+// are not limited: without authentication and for admin keys
+func (s *Server) limitsOf(key *model.APIKey) *model.Limits {
+	if key == nil || key.Admin {
+		return nil
+	}
+
+	if key.Limits != nil {
+		return key.Limits
+	}
+
+	return &s.defaultLimits
+}
+
+// quotaError rejects a submission exceeding a quota of its API key
+type quotaError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return e.message
+}
+
+// checkSubmissionQuota checks that a job of images fits in the active jobs and
+// daily images quotas of key. The caller holds the submit lock of the key, so
+// that the job is inserted before another submission is checked.
+func (s *Server) checkSubmissionQuota(ctx context.Context, key *model.APIKey, limits *model.Limits, images int) error {
+	if limits.ActiveJobs <= 0 && limits.ImagesPerDay <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	day := quota.NextDay(now).Add(-24 * time.Hour)
+
+	activeJobs, imagesToday, err := s.jobs.GetSubmissionUsage(ctx, key.ID, day)
+	if err != nil {
+		return err
+	}
+
+	if limits.ActiveJobs > 0 && activeJobs >= int64(limits.ActiveJobs) {
+		return &quotaError{
+			message:    fmt.Sprintf("limit of %d active jobs reached, wait for a job to finish", limits.ActiveJobs),
+			retryAfter: activeJobsRetryAfter,
+		}
+	}
+
+	if limits.ImagesPerDay > 0 && imagesToday+int64(images) > int64(limits.ImagesPerDay) {
+		return &quotaError{
+			message:    fmt.Sprintf("daily limit of %d images exceeded, %d images submitted today", limits.ImagesPerDay, imagesToday),
+			retryAfter: quota.NextDay(now).Sub(now),
+		}
+	}
+
+	return nil
+}
+
+// insertJob stores a new job of images, first checking that it fits in the
+// quotas of key when limits is not nil
+func (s *Server) insertJob(ctx context.Context, key *model.APIKey, limits *model.Limits, sv model.StoresVisit, images int) (primitive.ObjectID, error) {
+	if limits == nil {
+		return s.jobs.InsertStoresVisit(ctx, sv)
+	}
+
+	// concurrent submissions of the key could overrun the quotas together
+	unlock := s.submitLocks.Lock(key.ID.Hex())
+	defer unlock()
+
+	if err := s.checkSubmissionQuota(ctx, key, limits, images); err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	return s.jobs.InsertStoresVisit(ctx, sv)
+}
+
+// sendTooManyRequests answers 429 with the Retry-After header, in whole seconds
+func sendTooManyRequests(err string, retryAfter time.Duration, w http.ResponseWriter) {
+	seconds := max(1, int(math.Ceil(retryAfter.Seconds())))
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendErrBackWithStatus(err, http.StatusTooManyRequests, w)
+}
+
+// UsageHandler reports the limits of the caller's API key and how much of them is used
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	key := APIKeyFromContext(r.Context())
+
+	now := time.Now()
+	nextDay := quota.NextDay(now)
+
+	activeJobs, imagesToday, err := s.jobs.GetSubmissionUsage(r.Context(), key.ID, nextDay.Add(-24*time.Hour))
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	requests, requestsReset := s.rateLimiter.Count(key.ID.Hex())
+
+	type Usage struct {
+		RequestsThisMinute int   `json:"requests_this_minute"`
+		ActiveJobs         int64 `json:"active_jobs"`
+		ImagesToday        int64 `json:"images_today"`
+	}
+
+	type Resets struct {
+		Requests time.Time `json:"requests"`
+		Images   time.Time `json:"images"`
+	}
+
+	res := struct {
+		KeyID string `json:"key_id"`
+		Owner string `json:"owner"`
+		// Limits is omitted for admin keys, which are not limited
+		Limits *model.Limits `json:"limits,omitempty"`
+		Usage  Usage         `json:"usage"`
+		Resets Resets        `json:"resets"`
+	}{
+		KeyID:  key.ID.Hex(),
+		Owner:  key.Owner,
+		Limits: s.limitsOf(key),
+		Usage: Usage{
+			RequestsThisMinute: requests,
+			ActiveJobs:         activeJobs,
+			ImagesToday:        imagesToday,
+		},
+		Resets: Resets{
+			Requests: requestsReset.UTC(),
+			Images:   nextDay,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// validateLimits checks limits given to a key by an admin
+func validateLimits(limits *model.Limits) error {
+	if limits == nil {
+		return nil
+	}
+
+	if limits.RequestsPerMinute < 0 || limits.ActiveJobs < 0 || limits.ImagesPerJob < 0 || limits.ImagesPerDay < 0 {
+		return fmt.Errorf("limits can not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"image-job-processor/internal/model"
+	"time"
+)
+
+// submitRequest is the body of a job submission. visit_time is kept as a string
+// so that a malformed value is reported by validateData along with every other
+// problem, instead of failing the JSON decoding.
+type submitRequest struct {
+	Count       int            `json:"count"`
+	Visits      []visitRequest `json:"visits"`
+	CallbackURL string         `json:"callback_url,omitempty"`
+}
+
+type visitRequest struct {
+	StoreID   string   `json:"store_id"`
+	VisitTime string   `json:"visit_time"`
+	ImageURLs []string `json:"image_url"`
+}
+
+// imageCount returns the number of images of all visits
+func (req *submitRequest) imageCount() int {
+	count := 0
+	for _, v := range req.Visits {
+		count += len(v.ImageURLs)
+	}
+	return count
+}
+
+// toModel converts a validated request into the job document
+func (req *submitRequest) toModel() model.StoresVisit {
+	sv := model.StoresVisit{
+		Count:       req.Count,
+		Visits:      make([]model.VisitInfo, len(req.Visits)),
+		CallbackURL: req.CallbackURL,
+	}
+
+	for i, v := range req.Visits {
+		visitTime, _ := time.Parse(time.RFC3339, v.VisitTime)
+
+		sv.Visits[i] = model.VisitInfo{
+			StoreID:   v.StoreID,
+			VisitTime: visitTime.UTC(),
+			ImageURLs: v.ImageURLs,
+		}
+	}
+
+	return sv
+}
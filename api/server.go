@@ -0,0 +1,168 @@
+package api
+
+import (
+	"image-job-processor/internal/events"
+	"image-job-processor/internal/files"
+	"image-job-processor/internal/job"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/quota"
+	"image-job-processor/internal/service"
+	"image-job-processor/internal/store"
+	"image-job-processor/internal/tracing"
+	"image-job-processor/internal/urlpolicy"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+)
+
+// Dependencies of a Server
+type Dependencies struct {
+	// Jobs stores the jobs and Keys the Idempotency-Key records
+	Jobs service.JobRepository
+	Keys service.IdempotencyRepository
+	// APIKeys stores the hashed API keys, they are only checked when AuthEnabled
+	APIKeys     service.APIKeyRepository
+	AuthEnabled bool
+	// DefaultLimits bound the submissions made with the keys having no limits of
+	// their own. Admin keys are not limited.
+	DefaultLimits model.Limits
+	// Pool processes the accepted jobs
+	Pool *job.Pool
+	// Stores is the store master the submissions are checked against
+	Stores *store.StoreManager
+	// StoresService, Visits and Analytics read and edit the collections behind
+	// the store master, the store visits and the analytics endpoints. They are
+	// nil when running without MongoDB, the endpoints needing them are then
+	// read only or not served.
+	StoresService *service.StoresService
+	Visits        *service.StoresVisitService
+	Analytics     *service.AnalyticsService
+	// Seed is the load report of the CSV file that seeded the stores collection
+	// at startup, nil if no seeding happened
+	Seed *store.LoadInfo
+	// Storage is where the processed images are saved
+	Storage *files.Storage
+	// Broker delivers the progress of the jobs to the event streams
+	Broker events.Broker
+	Log    *logger.Logger
+	// ValidateStoreIDs rejects submissions with unknown store IDs up front.
+	// When false, unknown store IDs only fail the job once ProcessJob reaches them.
+	ValidateStoreIDs bool
+	// CallbacksEnabled accepts the jobs with a callback_url. It is false when
+	// no webhook secret is set, the callbacks could not be trusted.
+	CallbacksEnabled bool
+	// Lease is set on the submitted jobs, the App renews it
+	Lease job.Lease
+	// URLPolicy rejects the image URLs that may not be downloaded, the default
+	// policy when nil
+	URLPolicy *urlpolicy.Policy
+}
+
+// Server serves the API from the dependencies it was created with, so that
+// several servers, backed by MongoDB or kept in memory, can run in one process
+type Server struct {
+	jobs             service.JobRepository
+	keys             service.IdempotencyRepository
+	apiKeys          service.APIKeyRepository
+	authEnabled      bool
+	defaultLimits    model.Limits
+	rateLimiter      *quota.RateLimiter
+	submitLocks      *quota.KeyedMutex
+	pool             *job.Pool
+	stores           *store.StoreManager
+	storesService    *service.StoresService
+	visits           *service.StoresVisitService
+	analytics        *service.AnalyticsService
+	seed             *store.LoadInfo
+	storage          *files.Storage
+	broker           events.Broker
+	log              *logger.Logger
+	validateStoreIDs bool
+	callbacksEnabled bool
+	lease            job.Lease
+	urlPolicy        *urlpolicy.Policy
+}
+
+// NewServer creates a Server using deps
+func NewServer(deps Dependencies) *Server {
+	urlPolicy := deps.URLPolicy
+	if urlPolicy == nil {
+		urlPolicy = urlpolicy.New(urlpolicy.Settings{})
+	}
+
+	return &Server{
+		jobs:             deps.Jobs,
+		keys:             deps.Keys,
+		apiKeys:          deps.APIKeys,
+		authEnabled:      deps.AuthEnabled,
+		defaultLimits:    deps.DefaultLimits,
+		rateLimiter:      quota.NewRateLimiter(),
+		submitLocks:      quota.NewKeyedMutex(),
+		pool:             deps.Pool,
+		stores:           deps.Stores,
+		storesService:    deps.StoresService,
+		visits:           deps.Visits,
+		analytics:        deps.Analytics,
+		seed:             deps.Seed,
+		storage:          deps.Storage,
+		broker:           deps.Broker,
+		log:              deps.Log,
+		validateStoreIDs: deps.ValidateStoreIDs,
+		callbacksEnabled: deps.CallbacksEnabled,
+		lease:            deps.Lease,
+		urlPolicy:        urlPolicy,
+	}
+}
+
+// Handler routes the requests to the handlers of s
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	// first, so that the request ID and metrics middlewares see the span.
+	// Probes are not traced, they would outnumber every other request.
+	r.Use(otelmux.Middleware(tracing.ServiceName, otelmux.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/healthz" && r.URL.Path != "/readyz"
+	})))
+	r.Use(s.RequestIDMiddleware)
+	r.Use(MetricsMiddleware)
+	r.Use(s.AuthMiddleware)
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.ReadyzHandler).Methods("GET")
+	r.HandleFunc("/api/status", s.GetJobInfoHandler).Methods("GET")
+	r.HandleFunc("/api/submit", s.SubmitJobHandler).Methods("POST")
+	r.HandleFunc("/api/jobs", s.ListJobsHandler).Methods("GET")
+	// usage is counted per API key
+	if s.authEnabled {
+		r.HandleFunc("/api/usage", s.UsageHandler).Methods("GET")
+	}
+	r.HandleFunc("/api/jobs/{id}", s.GetJobResultHandler).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}/events/stream", s.JobEventsStreamHandler).Methods("GET")
+	r.HandleFunc("/api/stores", s.ListStoresHandler).Methods("GET")
+	r.HandleFunc("/api/stores", s.adminOnly(s.CreateStoreHandler)).Methods("POST")
+	r.HandleFunc("/api/stores/export", s.ExportStoresHandler).Methods("GET")
+	r.HandleFunc("/api/stores/stats", s.StoresStatsHandler).Methods("GET")
+	r.HandleFunc("/api/stores/import", s.adminOnly(s.ImportStoresHandler)).Methods("POST")
+	r.HandleFunc("/api/stores/{id}", s.GetStoreHandler).Methods("GET")
+	r.HandleFunc("/api/stores/{id}", s.adminOnly(s.UpdateStoreHandler)).Methods("PUT")
+	r.HandleFunc("/api/stores/{id}", s.adminOnly(s.DeleteStoreHandler)).Methods("DELETE")
+	// the visits and analytics span the jobs of every client
+	if s.visits != nil {
+		r.HandleFunc("/api/stores/{id}/visits", s.adminOnly(s.StoreVisitsHandler)).Methods("GET")
+	}
+	if s.analytics != nil {
+		r.HandleFunc("/api/analytics/stores", s.adminOnly(s.StoreAnalyticsHandler)).Methods("GET")
+		r.HandleFunc("/api/analytics/areas", s.adminOnly(s.AreaAnalyticsHandler)).Methods("GET")
+	}
+	r.HandleFunc("/api/admin/stores/reload", s.adminOnly(s.ReloadStoresHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/log-level", s.adminOnly(s.GetLogLevelHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/log-level", s.adminOnly(s.SetLogLevelHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/keys", s.adminOnly(s.ListAPIKeysHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/keys", s.adminOnly(s.CreateAPIKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/keys/{id}", s.adminOnly(s.DeleteAPIKeyHandler)).Methods("DELETE")
+	r.HandleFunc("/api/admin/keys/{id}/limits", s.adminOnly(s.SetAPIKeyLimitsHandler)).Methods("PUT")
+
+	return r
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/service"
+	"image-job-processor/internal/store"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ListStoresHandler returns every store in the store master
+func (s *Server) ListStoresHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.loadedStoreManager(w)
+	if !ok {
+		return
+	}
+
+	stores := sm.Stores()
+
+	res := struct {
+		Version int64         `json:"version"`
+		Count   int           `json:"count"`
+		Stores  []model.Store `json:"stores"`
+	}{
+		Version: sm.Info().Version,
+		Count:   len(stores),
+		Stores:  stores,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetStoreHandler returns a single store from the store master
+func (s *Server) GetStoreHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.loadedStoreManager(w)
+	if !ok {
+		return
+	}
+
+	st, exists := sm.GetStore(mux.Vars(r)["id"])
+
+	if !exists {
+		sendErrBackWithStatus("store does not exist", http.StatusNotFound, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(st)
+}
+
+// ReloadStoresHandler reloads the store master and reports the loaded version
+func (s *Server) ReloadStoresHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := s.stores.Reload(r.Context())
+
+	if err != nil {
+		sendErrBackWithStatus(fmt.Sprintf("failed to reload store master: %v", err), http.StatusInternalServerError, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// CreateStoreHandler adds a store to the store master
+func (s *Server) CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.writableStoreManager(w)
+	if !ok {
+		return
+	}
+
+	var st model.Store
+
+	if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+		sendErrBack("JSON decoding error", w)
+		return
+	}
+
+	st.ID = strings.TrimSpace(st.ID)
+
+	if st.ID == "" {
+		sendErrBack("store_id is required", w)
+		return
+	}
+
+	if err := s.storesService.InsertStore(r.Context(), st); err != nil {
+		if errors.Is(err, service.ErrStoreExists) {
+			sendErrBackWithStatus("store already exists", http.StatusConflict, w)
+			return
+		}
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	reloadStores(r.Context(), sm)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(st)
+}
+
+// UpdateStoreHandler replaces a store in the store master
+func (s *Server) UpdateStoreHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.writableStoreManager(w)
+	if !ok {
+		return
+	}
+
+	var st model.Store
+
+	if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+		sendErrBack("JSON decoding error", w)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+
+	if st.ID != "" && st.ID != id {
+		sendErrBack("store_id in the body does not match the url", w)
+		return
+	}
+	st.ID = id
+
+	if err := s.storesService.UpdateStore(r.Context(), st); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sendErrBackWithStatus("store does not exist", http.StatusNotFound, w)
+			return
+		}
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	reloadStores(r.Context(), sm)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(st)
+}
+
+// DeleteStoreHandler removes a store from the store master
+func (s *Server) DeleteStoreHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.writableStoreManager(w)
+	if !ok {
+		return
+	}
+
+	if err := s.storesService.DeleteStore(r.Context(), mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sendErrBackWithStatus("store does not exist", http.StatusNotFound, w)
+			return
+		}
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	reloadStores(r.Context(), sm)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImportStoresHandler upserts every store in the CSV request body
+func (s *Server) ImportStoresHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.writableStoreManager(w)
+	if !ok {
+		return
+	}
+
+	stores, report, err := store.ParseCSV(r.Body)
+
+	if err != nil {
+		sendErrBack(fmt.Sprintf("invalid csv: %v", err), w)
+		return
+	}
+
+	inserted, updated, err := s.storesService.UpsertStores(r.Context(), stores)
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	reloadStores(r.Context(), sm)
+
+	res := struct {
+		store.Report
+		Inserted int64 `json:"inserted"`
+		Updated  int64 `json:"updated"`
+	}{
+		Report:   report,
+		Inserted: inserted,
+		Updated:  updated,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// ExportStoresHandler returns the store master as CSV
+func (s *Server) ExportStoresHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.loadedStoreManager(w)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="stores.csv"`)
+	w.WriteHeader(http.StatusOK)
+	store.WriteCSV(w, sm.Stores())
+}
+
+// loadedStoreManager returns the store manager once the store master has been loaded
+func (s *Server) loadedStoreManager(w http.ResponseWriter) (*store.StoreManager, bool) {
+	if s.stores.Info().Version == 0 {
+		sendErrBackWithStatus("store master is not available", http.StatusInternalServerError, w)
+		return nil, false
+	}
+
+	return s.stores, true
+}
+
+// writableStoreManager returns the store manager if the store master can be
+// modified, i.e. it is kept in mongodb and not in a CSV file
+func (s *Server) writableStoreManager(w http.ResponseWriter) (*store.StoreManager, bool) {
+	sm, ok := s.loadedStoreManager(w)
+	if !ok {
+		return nil, false
+	}
+
+	if _, ok := sm.Source().(*store.MongoSource); !ok || s.storesService == nil {
+		sendErrBackWithStatus("store master is read only when loaded from a csv file", http.StatusConflict, w)
+		return nil, false
+	}
+
+	return sm, true
+}
+
+// reloadStores refreshes the local cache right away, other replicas pick the
+// change up on their next refresh
+func reloadStores(ctx context.Context, sm *store.StoreManager) {
+	if _, err := sm.Reload(ctx); err != nil {
+		logger.FromContext(ctx).Error("Failed to reload store master", "error", err)
+	}
+}
+
+// StoresStatsHandler reports how the store master was loaded, including the
+// rows that were skipped
+func (s *Server) StoresStatsHandler(w http.ResponseWriter, r *http.Request) {
+	res := struct {
+		Current store.LoadInfo  `json:"current"`
+		Seed    *store.LoadInfo `json:"seed,omitempty"`
+	}{
+		Current: s.stores.Info(),
+		Seed:    s.seed,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+const (
+	defaultVisitsLimit = 100
+	maxVisitsLimit     = 1000
+)
+
+// StoreVisitsHandler returns every visit of a store across all jobs, ordered by
+// visit time, optionally limited to a from/to date range
+func (s *Server) StoreVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	storeID := mux.Vars(r)["id"]
+
+	from, to, err := parseDateRange(r)
+
+	if err != nil {
+		sendErrBack(err.Error(), w)
+		return
+	}
+
+	limit := int64(defaultVisitsLimit)
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 || limit > maxVisitsLimit {
+			sendErrBack(fmt.Sprintf("limit must be between 1 and %d", maxVisitsLimit), w)
+			return
+		}
+	}
+
+	visits, err := s.visits.FindVisitsByStoreID(r.Context(), storeID, from, to, limit)
+
+	if err != nil {
+		sendErrBackWithStatus(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	type ImageResult struct {
+		URL       string `json:"url"`
+		ImageID   string `json:"image_id,omitempty"`
+		Perimeter int64  `json:"perimeter,omitempty"`
+	}
+
+	type VisitResult struct {
+		JobID     string        `json:"job_id"`
+		JobStatus string        `json:"job_status"`
+		VisitTime time.Time     `json:"visit_time"`
+		Images    []ImageResult `json:"images"`
+	}
+
+	res := struct {
+		StoreID   string        `json:"store_id"`
+		StoreName string        `json:"store_name"`
+		AreaCode  string        `json:"area_code"`
+		Count     int           `json:"count"`
+		Visits    []VisitResult `json:"visits"`
+	}{
+		StoreID: storeID,
+		Count:   len(visits),
+		Visits:  make([]VisitResult, 0, len(visits)),
+	}
+
+	if st, exists := s.stores.GetStore(storeID); exists {
+		res.StoreName = st.Name
+		res.AreaCode = st.AreaCode
+	}
+
+	for _, v := range visits {
+		vr := VisitResult{
+			JobID:     v.JobID.Hex(),
+			JobStatus: v.JobStatus,
+			VisitTime: v.VisitTime,
+			Images:    make([]ImageResult, len(v.ImageURLs)),
+		}
+
+		for i, imgURL := range v.ImageURLs {
+			vr.Images[i].URL = imgURL
+			if i < len(v.ImageUUIDs) {
+				vr.Images[i].ImageID = v.ImageUUIDs[i]
+			}
+			if i < len(v.Perimeters) {
+				vr.Images[i].Perimeter = v.Perimeters[i]
+			}
+		}
+
+		res.Visits = append(res.Visits, vr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
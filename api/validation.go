@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image-job-processor/internal/store"
+	"image-job-processor/internal/urlpolicy"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Validation error codes
+const (
+	codeRequired          = "required"
+	codeOutOfRange        = "out_of_range"
+	codeMismatch          = "mismatch"
+	codeInvalidURL        = "invalid_url"
+	codeUnsupportedScheme = "unsupported_scheme"
+	codeInvalidTime       = "invalid_time"
+	codeDuplicate         = "duplicate"
+	codeUnknownStore      = "unknown_store"
+	codeTooManyImages     = "too_many_images"
+	codeHostNotAllowed    = "host_not_allowed"
+	codeBlockedAddress    = "blocked_address"
+	codeCallbacksDisabled = "callbacks_disabled"
+)
+
+// FieldError describes a single problem found in a submission
+type FieldError struct {
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validateImageCount checks the number of images of a submission against the
+// images per job limit of the client, 0 being no limit
+func validateImageCount(sv *submitRequest, limit int) []FieldError {
+	if limit <= 0 {
+		return nil
+	}
+
+	if images := sv.imageCount(); images > limit {
+		return []FieldError{{
+			Path:    "visits",
+			Code:    codeTooManyImages,
+			Message: fmt.Sprintf("the job has %d images, more than the limit of %d images per job", images, limit),
+		}}
+	}
+
+	return nil
+}
+
+// validateData checks the whole submission, the image and callback URLs
+// against policy, and returns every problem found
+func validateData(sv *submitRequest, policy *urlpolicy.Policy) []FieldError {
+	var errs []FieldError
+
+	add := func(path, code, format string, args ...any) {
+		errs = append(errs, FieldError{Path: path, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if sv.Count < 0 {
+		add("count", codeOutOfRange, "count can not be less than zero")
+	}
+
+	if len(sv.Visits) == 0 {
+		add("visits", codeRequired, "visits should not be empty")
+	} else if len(sv.Visits) != sv.Count {
+		add("count", codeMismatch, "count (%d) does not match the number of visits (%d)", sv.Count, len(sv.Visits))
+	}
+
+	if sv.CallbackURL != "" {
+		if code, mssg := checkPolicyURL(sv.CallbackURL, policy); code != "" {
+			add("callback_url", code, "%s", mssg)
+		}
+	}
+
+	// path of the first occurrence of every image url, to flag duplicates
+	seenURLs := make(map[string]string)
+
+	for i, v := range sv.Visits {
+		visitPath := fmt.Sprintf("visits[%d]", i)
+
+		if v.StoreID == "" {
+			add(visitPath+".store_id", codeRequired, "store_id is required")
+		}
+
+		if v.VisitTime == "" {
+			add(visitPath+".visit_time", codeRequired, "visit_time is required")
+		} else if _, err := time.Parse(time.RFC3339, v.VisitTime); err != nil {
+			add(visitPath+".visit_time", codeInvalidTime, "visit_time must be an RFC3339 timestamp such as 2024-11-16T10:30:00Z")
+		}
+
+		if len(v.ImageURLs) == 0 {
+			add(visitPath+".image_url", codeRequired, "image_url cannot be empty")
+		}
+
+		for j, imgURL := range v.ImageURLs {
+			urlPath := fmt.Sprintf("%s.image_url[%d]", visitPath, j)
+
+			if imgURL == "" {
+				add(urlPath, codeRequired, "image url can not be empty")
+				continue
+			}
+
+			if code, mssg := checkPolicyURL(imgURL, policy); code != "" {
+				add(urlPath, code, "%s", mssg)
+				continue
+			}
+
+			if first, ok := seenURLs[imgURL]; ok {
+				add(urlPath, codeDuplicate, "duplicate of %s", first)
+				continue
+			}
+			seenURLs[imgURL] = urlPath
+		}
+	}
+
+	return errs
+}
+
+// validateStoreIDs checks every store_id against the store master and returns
+// an error per visit along with the distinct unknown IDs
+func validateStoreIDs(sv *submitRequest, sm *store.StoreManager) ([]FieldError, []string) {
+	var errs []FieldError
+	var unknown []string
+
+	seen := make(map[string]struct{})
+
+	for i, v := range sv.Visits {
+		if v.StoreID == "" || sm.StoreIDExists(v.StoreID) {
+			continue
+		}
+
+		errs = append(errs, FieldError{
+			Path:    fmt.Sprintf("visits[%d].store_id", i),
+			Code:    codeUnknownStore,
+			Message: fmt.Sprintf("store ID %s does not exist", v.StoreID),
+		})
+
+		if _, ok := seen[v.StoreID]; !ok {
+			seen[v.StoreID] = struct{}{}
+			unknown = append(unknown, v.StoreID)
+		}
+	}
+
+	return errs, unknown
+}
+
+// checkPolicyURL returns an error code and message if rawURL is not an
+// absolute url that policy allows the service to send requests to, the policy
+// decides which schemes are allowed
+func checkPolicyURL(rawURL string, policy *urlpolicy.Policy) (string, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return codeInvalidURL, "must be an absolute url"
+	}
+
+	err = policy.CheckURL(u)
+	switch {
+	case err == nil:
+		return "", ""
+	case errors.Is(err, urlpolicy.ErrScheme):
+		return codeUnsupportedScheme, err.Error()
+	case errors.Is(err, urlpolicy.ErrHost):
+		return codeHostNotAllowed, err.Error()
+	default:
+		return codeBlockedAddress, err.Error()
+	}
+}
+
+func sendValidationErrors(errs []FieldError, unknownStoreIDs []string, w http.ResponseWriter) {
+	res := struct {
+		Error           string       `json:"error"`
+		Errors          []FieldError `json:"errors"`
+		UnknownStoreIDs []string     `json:"unknown_store_ids,omitempty"`
+	}{
+		Error:           "validation failed",
+		Errors:          errs,
+		UnknownStoreIDs: unknownStoreIDs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(res)
+}
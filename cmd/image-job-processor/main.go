@@ -1,42 +1,99 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
-	"image-job-processor/api"
-	"image-job-processor/internal/logger"
-	"image-job-processor/internal/service"
-	"image-job-processor/internal/store"
+	"image-job-processor/internal/app"
+	"image-job-processor/internal/config"
+	"image-job-processor/internal/tracing"
+	"log"
+	"net"
 	"net/http"
-
-	"github.com/gorilla/mux"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	logger := logger.GetLogger()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+
+	// cancelled on SIGINT or SIGTERM to start the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// reading cmd args
-	port := flag.Int("p", 8080, "Port number to start server on")
-	file := flag.String("f", "StoreMasterAssignment.csv", "File name to read")
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Settings{
+		Exporter:     cfg.Tracing.Exporter,
+		OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+		OTLPInsecure: cfg.Tracing.OTLPInsecure,
+		SampleRatio:  cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
 
-	// parse the command line flags
-	flag.Parse()
+	a, err := app.New(ctx, cfg, app.Options{})
+	if err != nil {
+		log.Fatalf("failed to start: %v", err)
+	}
 
-	// set csv file
-	store.CsvFilePath = *file
-	logger.Log(fmt.Sprintf("Reading csv file %s", *file))
-	store.NewStoreManager()
+	logger := a.Logger()
 
-	// establish connection to mongodb
-	service.NewStoresVisitService()
+	a.Start(ctx)
 
-	// routes and handlers
-	r := mux.NewRouter()
-	r.HandleFunc("/api/status", api.GetJobInfoHandler).Methods("GET")
-	r.HandleFunc("/api/submit", api.SubmitJobHandler).Methods("POST")
+	// request contexts derive from serverCtx, cancelling it on shutdown ends the
+	// event streams that would otherwise keep their connections open
+	serverCtx, cancelServerCtx := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:              fmt.Sprintf("0.0.0.0:%d", cfg.Server.Port),
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		BaseContext:       func(net.Listener) context.Context { return serverCtx },
+	}
+	server.RegisterOnShutdown(cancelServerCtx)
 
 	// start server
-	logger.Log(fmt.Sprintf("Starting server on port %v", *port))
-	logger.Log("-------------INIT DONE-------------")
-	http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", *port), r)
+	logger.Info("Starting server", "port", cfg.Server.Port)
+	logger.Info("-------------INIT DONE-------------")
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("server stopped: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	shutdown(server, a, shutdownTracing, cfg.Timeouts.Shutdown)
+}
+
+// shutdown stops accepting requests, drains the job queue within timeout and
+// checkpoints the jobs still running, then flushes the spans and releases the
+// database and the logger
+func shutdown(server *http.Server, a *app.App, shutdownTracing func(context.Context) error, timeout time.Duration) {
+	logger := a.Logger()
+	logger.Info("Shutting down, waiting for running jobs", "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Failed to close all connections", "error", err)
+	}
+
+	a.Shutdown(ctx)
+
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Warn("Failed to flush spans", "error", err)
+	}
+
+	logger.Info("-------------SHUTDOWN DONE-------------", "dropped_log_messages", logger.Dropped(), "spilled_log_messages", logger.Spilled())
+	logger.Stop()
 }
@@ -0,0 +1,447 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image-job-processor/api"
+	"image-job-processor/internal/config"
+	"image-job-processor/internal/db"
+	"image-job-processor/internal/events"
+	"image-job-processor/internal/files"
+	"image-job-processor/internal/job"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/service"
+	"image-job-processor/internal/store"
+	"image-job-processor/internal/urlpolicy"
+	"image-job-processor/internal/webhook"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Options replace the dependencies New would otherwise build from the configuration
+type Options struct {
+	// Jobs and Keys replace the MongoDB repositories. When both are set no
+	// connection to MongoDB is made and the endpoints needing it are not served.
+	Jobs service.JobRepository
+	Keys service.IdempotencyRepository
+	// APIKeys replaces the MongoDB API key repository. Without MongoDB the keys
+	// are kept in memory.
+	APIKeys service.APIKeyRepository
+	// StoreSource replaces the source of the store master chosen by the configuration
+	StoreSource store.Source
+	// Logger replaces the logger built from the configuration
+	Logger *logger.Logger
+	// HTTPClient downloads the images and posts the callbacks, a client
+	// enforcing the fetch configuration when nil
+	HTTPClient *http.Client
+	// Clock and Rand time the simulated processing of the images, see
+	// job.Dependencies
+	Clock job.Clock
+	Rand  job.Rand
+}
+
+// App holds every component of the application, wired together from a
+// configuration. Apps share no state, several of them can run in one process.
+type App struct {
+	cfg    *config.Config
+	log    *logger.Logger
+	client *mongo.Client
+
+	jobs     service.JobRepository
+	stores   *store.StoreManager
+	pool     *job.Pool
+	webhooks *webhook.Deliverer
+	server   *api.Server
+
+	// lease holds the jobs of the App, see keepLeases
+	lease      job.Lease
+	stopLeases context.CancelFunc
+	leasesDone chan struct{}
+}
+
+// New builds an App from cfg, connecting to MongoDB unless opts replaces both
+// repositories, loading the store master and starting the job workers
+func New(ctx context.Context, cfg *config.Config, opts Options) (_ *App, err error) {
+	a := &App{cfg: cfg, log: opts.Logger, lease: job.NewLease(cfg.Jobs.LeaseTTL)}
+	if a.log == nil {
+		level, _ := logger.ParseLevel(cfg.Logging.Level)
+		a.log = logger.New(logger.Settings{
+			Sink:           cfg.Logging.Sink,
+			Dir:            cfg.Logging.Dir,
+			Format:         cfg.Logging.Format,
+			Level:          level,
+			Overflow:       cfg.Logging.Overflow,
+			BufferSize:     cfg.Logging.BufferSize,
+			MaxSize:        int64(cfg.Logging.MaxSizeMB) << 20,
+			RotateInterval: cfg.Logging.RotateInterval,
+			MaxBackups:     cfg.Logging.MaxBackups,
+			MaxAge:         cfg.Logging.MaxAge,
+		})
+	}
+	ctx = logger.NewContext(ctx, a.log)
+
+	defer func() {
+		if err != nil && a.client != nil {
+			db.Disconnect(a.client, cfg.Timeouts.MongoConnect)
+		}
+	}()
+
+	urlPolicy := urlpolicy.New(urlpolicy.Settings{
+		Schemes:              cfg.Fetch.AllowedSchemes,
+		AllowPrivateNetworks: cfg.Fetch.AllowPrivateNetworks,
+		AllowedHosts:         cfg.Fetch.AllowedHosts,
+		DeniedHosts:          cfg.Fetch.DeniedHosts,
+		MaxRedirects:         cfg.Fetch.MaxRedirects,
+	})
+
+	// the image and callback URLs come from the clients
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = urlPolicy.Client()
+	}
+
+	deps := api.Dependencies{
+		Jobs:             opts.Jobs,
+		Keys:             opts.Keys,
+		APIKeys:          opts.APIKeys,
+		AuthEnabled:      cfg.Auth.Enabled,
+		Storage:          files.NewStorage(cfg.Storage.Dir),
+		Broker:           events.NewBroker(),
+		Log:              a.log,
+		ValidateStoreIDs: !cfg.Stores.LazyCheck,
+		URLPolicy:        urlPolicy,
+		CallbacksEnabled: cfg.Webhook.Secret != "",
+		Lease:            a.lease,
+		DefaultLimits: model.Limits{
+			RequestsPerMinute: cfg.Limits.RequestsPerMinute,
+			ActiveJobs:        cfg.Limits.ActiveJobs,
+			ImagesPerJob:      cfg.Limits.ImagesPerJob,
+			ImagesPerDay:      cfg.Limits.ImagesPerDay,
+		},
+	}
+
+	if cfg.Webhook.Secret == "" {
+		a.log.Warn("No webhook secret is set, jobs with a callback_url are rejected")
+	}
+
+	if opts.Jobs == nil || opts.Keys == nil {
+		if err := a.connect(ctx, &deps); err != nil {
+			return nil, err
+		}
+	}
+	a.jobs = deps.Jobs
+
+	if deps.APIKeys == nil {
+		deps.APIKeys = service.NewMemoryAPIKeyRepository()
+	}
+	if err := a.bootstrapAPIKey(ctx, deps.APIKeys); err != nil {
+		return nil, err
+	}
+
+	source := opts.StoreSource
+	if source == nil {
+		source, deps.Seed, err = a.storeSource(ctx, deps.StoresService)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.stores, err = store.NewStoreManager(ctx, source, a.log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load store master: %w", err)
+	}
+	deps.Stores = a.stores
+
+	a.webhooks = webhook.NewDeliverer(deps.Jobs, webhook.Settings{
+		Secret:         cfg.Webhook.Secret,
+		MaxAttempts:    cfg.Webhook.MaxAttempts,
+		InitialBackoff: cfg.Webhook.InitialBackoff,
+		Timeout:        cfg.Timeouts.Webhook,
+		Client:         httpClient,
+	})
+
+	processor := job.NewProcessor(job.Dependencies{
+		Jobs:     deps.Jobs,
+		Stores:   a.stores,
+		Fetcher:  files.NewFetcher(httpClient, cfg.Timeouts.Download, int64(cfg.Storage.MaxImageSizeMB)<<20),
+		Storage:  deps.Storage,
+		Broker:   deps.Broker,
+		Webhooks: a.webhooks,
+		Log:      a.log,
+		Lease:    a.lease,
+		DBRetry: job.RetryPolicy{
+			Attempts: cfg.Jobs.DBRetryAttempts,
+			Backoff:  cfg.Jobs.DBRetryBackoff,
+		},
+		Clock: opts.Clock,
+		Rand:  opts.Rand,
+	})
+	a.pool = job.NewPool(processor, cfg.Jobs.Workers, cfg.Jobs.QueueSize)
+	deps.Pool = a.pool
+
+	a.server = api.NewServer(deps)
+
+	return a, nil
+}
+
+// connect connects to MongoDB and fills in the repositories and services of
+// deps that were not replaced
+func (a *App) connect(ctx context.Context, deps *api.Dependencies) error {
+	cfg := a.cfg
+
+	if cfg.Mongo.URI == "" {
+		return errors.New("mongo.uri is required to store the jobs, set MONGODB_URI or IJP_MONGO_URI")
+	}
+
+	client, err := db.Connect(ctx, db.Settings{
+		URI:             cfg.Mongo.URI,
+		ConnectTimeout:  cfg.Timeouts.MongoConnect,
+		ConnectAttempts: cfg.Mongo.ConnectAttempts,
+		ConnectBackoff:  cfg.Mongo.ConnectBackoff,
+	})
+	if err != nil {
+		return err
+	}
+	a.client = client
+
+	settings := service.Settings{
+		Database:              cfg.Mongo.Database,
+		JobsCollection:        cfg.Mongo.JobsCollection,
+		StoresCollection:      cfg.Mongo.StoresCollection,
+		IdempotencyCollection: cfg.Mongo.IdempotencyCollection,
+		APIKeysCollection:     cfg.Mongo.APIKeysCollection,
+		MigrationsCollection:  cfg.Mongo.MigrationsCollection,
+		OperationTimeout:      cfg.Timeouts.MongoOperation,
+	}
+
+	if deps.Jobs == nil {
+		svs := service.NewStoresVisitService(client, settings)
+		// the visit indexes only speed up lookups
+		if err := svs.CreateIndexes(ctx); err != nil {
+			a.log.Error("Failed to create visit indexes", "error", err)
+		}
+
+		// older versions stored visit_time as a free-form string
+		migrated, invalid, err := svs.MigrateVisitTimes(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to migrate visit times: %w", err)
+		}
+		if migrated > 0 {
+			a.log.Info("Converted visit_time to a timestamp", "jobs", migrated)
+		}
+		if invalid > 0 {
+			a.log.Warn("Some visit_time values are not timestamps, they are kept in visit_time_raw", "jobs", invalid)
+		}
+
+		// the store timeline and the analytics read the jobs collection
+		deps.Jobs = svs
+		deps.Visits = svs
+		deps.Analytics = service.NewAnalyticsService(client, settings)
+	}
+	if deps.Keys == nil {
+		// a key already taken is only detected through the unique index
+		keys := service.NewIdempotencyService(client, settings)
+		if err := keys.CreateIndexes(ctx); err != nil {
+			return fmt.Errorf("failed to create idempotency indexes: %w", err)
+		}
+		deps.Keys = keys
+	}
+	if deps.APIKeys == nil {
+		// the unique index keeps the key hashes unique
+		apiKeys := service.NewAPIKeyService(client, settings)
+		if err := apiKeys.CreateIndexes(ctx); err != nil {
+			return fmt.Errorf("failed to create api key indexes: %w", err)
+		}
+		deps.APIKeys = apiKeys
+	}
+	deps.StoresService = service.NewStoresService(client, settings)
+
+	return nil
+}
+
+// bootstrapAPIKey stores the configured bootstrap key as an admin key, unless
+// it is stored already
+func (a *App) bootstrapAPIKey(ctx context.Context, keys service.APIKeyRepository) error {
+	if a.cfg.Auth.BootstrapKey == "" {
+		return nil
+	}
+
+	_, err := keys.InsertAPIKey(ctx, service.APIKeyRecord(a.cfg.Auth.BootstrapKey, "admin", "bootstrap", true))
+	if err != nil && !errors.Is(err, service.ErrAPIKeyExists) {
+		return fmt.Errorf("failed to store bootstrap api key: %w", err)
+	}
+	if err == nil {
+		a.log.Info("Stored bootstrap api key")
+	}
+
+	return nil
+}
+
+// storeSource returns the source of the store master chosen by the
+// configuration, seeding the stores collection from the CSV file when it is
+// still empty. The load report of the seeding is returned, if it happened.
+func (a *App) storeSource(ctx context.Context, ss *service.StoresService) (store.Source, *store.LoadInfo, error) {
+	cfg := a.cfg
+
+	if cfg.Stores.Source != "mongo" {
+		a.log.Info("Reading csv file", "file", cfg.Stores.CSVPath)
+		return &store.CSVSource{Path: cfg.Stores.CSVPath}, nil, nil
+	}
+
+	if ss == nil {
+		return nil, nil, errors.New("the mongo store source needs MongoDB")
+	}
+
+	// the csv file only seeds an empty stores collection, and is only read
+	// then. Pass -f "" to skip it.
+	var seed *store.LoadInfo
+	if file := cfg.Stores.CSVPath; file != "" {
+		var err error
+		seed, err = store.SeedFromCSV(ctx, ss, file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to seed stores from csv file %s: %w", file, err)
+		}
+		if seed != nil {
+			a.log.Info("Seeded stores from csv file", "file", file, "stores", seed.Loaded, "issues", len(seed.Issues))
+		}
+	}
+
+	return &store.MongoSource{Stores: ss}, seed, nil
+}
+
+// Handler returns the HTTP handler serving the API
+func (a *App) Handler() http.Handler {
+	return a.server.Handler()
+}
+
+// Logger returns the logger of the App
+func (a *App) Logger() *logger.Logger {
+	return a.log
+}
+
+// Start watches the store master for changes, keeps the leases of the jobs of
+// the App and, as configured, claims the jobs left ongoing by the previous run
+// or by other replicas that stopped. The watch stops when ctx is done, the
+// leases are kept until Shutdown.
+func (a *App) Start(ctx context.Context) {
+	ctx = logger.NewContext(ctx, a.log)
+
+	if a.cfg.Stores.ReloadInterval > 0 {
+		go a.stores.Watch(ctx, a.cfg.Stores.ReloadInterval)
+	}
+
+	leaseCtx, cancel := context.WithCancel(logger.NewContext(context.Background(), a.log))
+	a.stopLeases = cancel
+	a.leasesDone = make(chan struct{})
+
+	if a.cfg.Jobs.Resume {
+		a.claimJobs(leaseCtx)
+	}
+
+	go a.keepLeases(leaseCtx)
+}
+
+// keepLeases renews the leases of the jobs queued or running in the pool, and
+// claims the jobs whose lease expired when resuming is enabled, until ctx is done
+func (a *App) keepLeases(ctx context.Context) {
+	defer close(a.leasesDone)
+
+	ticker := time.NewTicker(a.lease.RenewInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if held := a.pool.Held(); len(held) > 0 {
+			if err := a.jobs.RenewLeases(ctx, a.lease.Owner, a.lease.Until(), held); err != nil && ctx.Err() == nil {
+				a.log.Error("Failed to renew job leases", "error", err)
+			}
+		}
+
+		if a.cfg.Jobs.Resume {
+			a.claimJobs(ctx)
+		}
+	}
+}
+
+// claimJobs queues the ongoing jobs without a lease, or whose lease expired,
+// other than those already in the pool, while the queue has room. Images
+// already processed are skipped by ProcessJob.
+func (a *App) claimJobs(ctx context.Context) {
+	resumed := 0
+
+	for a.pool.Accepting() == nil {
+		sv, err := a.jobs.ClaimStoresVisit(ctx, a.lease.Owner, a.lease.Until(), a.pool.Held())
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				a.log.Error("Failed to claim ongoing jobs to resume", "error", err)
+			}
+			break
+		}
+
+		if err := a.pool.Enqueue(sv.ID, *sv); err != nil {
+			a.log.Warn("Could not resume job", "job_id", sv.ID.Hex(), "error", err)
+			// another instance may have room for it
+			if err := a.jobs.ReleaseLeases(ctx, a.lease.Owner, sv.ID); err != nil {
+				a.log.Error("Failed to release job lease", "job_id", sv.ID.Hex(), "error", err)
+			}
+			break
+		}
+		resumed++
+	}
+
+	if resumed > 0 {
+		a.log.Info("Resumed ongoing jobs", "resumed", resumed)
+	}
+}
+
+// Shutdown drains the job queue and the pending callbacks until ctx is done,
+// checkpointing the jobs and interrupting the callbacks still running then,
+// and disconnects from MongoDB. It returns ctx.Err() if the queue or the
+// callbacks could not be drained in time. The logger is left running, see
+// Logger.
+func (a *App) Shutdown(ctx context.Context) error {
+	err := a.pool.Shutdown(ctx)
+	if err != nil {
+		a.log.Warn("Running jobs did not finish in time and were checkpointed")
+	} else {
+		a.log.Info("All jobs finished")
+	}
+
+	// the jobs finishing above may have started callbacks
+	if werr := a.webhooks.Shutdown(ctx); werr != nil {
+		a.log.Warn("Pending callbacks did not finish in time and were abandoned")
+		err = werr
+	}
+
+	if a.stopLeases != nil {
+		a.stopLeases()
+		<-a.leasesDone
+	}
+
+	// the jobs left ongoing can be resumed by the next start or another replica
+	// right away, instead of once their leases expire. ctx may be done already,
+	// the call is bounded by the operation timeout.
+	if err := a.jobs.ReleaseLeases(logger.NewContext(context.Background(), a.log), a.lease.Owner); err != nil {
+		a.log.Error("Failed to release job leases", "error", err)
+	}
+
+	if a.client != nil {
+		if err := db.Disconnect(a.client, a.cfg.Timeouts.MongoConnect); err != nil {
+			a.log.Error("Failed to disconnect from mongodb", "error", err)
+		}
+	}
+
+	return err
+}
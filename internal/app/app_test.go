@@ -0,0 +1,1262 @@
+package app_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image-job-processor/internal/app"
+	"image-job-processor/internal/config"
+	"image-job-processor/internal/events"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/service"
+	"image-job-processor/internal/webhook"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSubmitAndProcess(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, nil)
+
+	resp, id := ta.submit(job(
+		visit("S1", images.url(fixturePNG, ""), images.url(fixtureJPEG, "")),
+		visit("S2", images.url(fixturePNG, "second")),
+	))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		t.Fatalf("submit: invalid job id %q", id)
+	}
+
+	status := ta.waitForJob(id)
+	if status.Status != "completed" || status.Error != nil {
+		t.Fatalf("job ended %q with error %+v, want completed", status.Status, status.Error)
+	}
+
+	var res jobResult
+	if resp := ta.do(http.MethodGet, "/api/jobs/"+id, nil, nil, &res); resp.StatusCode != http.StatusOK {
+		t.Fatalf("result: got status %d", resp.StatusCode)
+	}
+
+	if res.JobID != id || res.Status != "completed" || res.Count != 2 || len(res.Visits) != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	want := []struct {
+		storeID, storeName, areaCode string
+		perimeters                   []int64
+		formats                      []string
+	}{
+		{"S1", "First Store", "A1", []int64{12, 35}, []string{".png", ".jpeg"}},
+		{"S2", "Second Store", "A2", []int64{12}, []string{".png"}},
+	}
+
+	for i, w := range want {
+		v := res.Visits[i]
+		if v.StoreID != w.storeID || v.StoreName != w.storeName || v.AreaCode != w.areaCode {
+			t.Errorf("visit %d: got store %s %q %s, want %s %q %s", i, v.StoreID, v.StoreName, v.AreaCode, w.storeID, w.storeName, w.areaCode)
+		}
+		if !v.VisitTime.Equal(time.Date(2024, 11, 16, 10, 30, 0, 0, time.UTC)) {
+			t.Errorf("visit %d: got visit time %s", i, v.VisitTime)
+		}
+		if len(v.Images) != len(w.perimeters) {
+			t.Fatalf("visit %d: got %d images, want %d", i, len(v.Images), len(w.perimeters))
+		}
+
+		for j, img := range v.Images {
+			if img.Perimeter != w.perimeters[j] {
+				t.Errorf("visit %d image %d: got perimeter %d, want %d", i, j, img.Perimeter, w.perimeters[j])
+			}
+			if !strings.HasSuffix(img.ImageID, w.formats[j]) {
+				t.Errorf("visit %d image %d: got image id %q, want a %s file", i, j, img.ImageID, w.formats[j])
+			}
+
+			path := filepath.Join(ta.StorageDir, id, w.storeID, img.ImageID)
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("visit %d image %d: image not saved: %v", i, j, err)
+			}
+		}
+	}
+
+	// every image waits for the simulated processing, drawn from the injected Rand
+	wantWait := (100 + processingRand) * time.Millisecond
+	waits := ta.Clock.Waits()
+	if len(waits) != 3 {
+		t.Fatalf("got %d processing delays, want 3", len(waits))
+	}
+	for _, wait := range waits {
+		if wait != wantWait {
+			t.Errorf("got processing delay %s, want %s", wait, wantWait)
+		}
+	}
+}
+
+func TestSubmitValidation(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, nil)
+
+	png := images.url(fixturePNG, "")
+
+	tests := []struct {
+		name       string
+		body       any
+		wantStatus int
+		// path and code of every expected field error
+		wantErrors      []string
+		wantUnknownIDs  []string
+		wantErrorSubstr string
+	}{
+		{
+			name:            "malformed json",
+			body:            `{"count": 1, "visits": [`,
+			wantStatus:      http.StatusBadRequest,
+			wantErrorSubstr: "JSON decoding error",
+		},
+		{
+			name:       "no visits",
+			body:       map[string]any{"count": 0, "visits": []any{}},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{"visits required"},
+		},
+		{
+			name:       "count mismatch",
+			body:       map[string]any{"count": 2, "visits": []any{visit("S1", png)}},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{"count mismatch"},
+		},
+		{
+			name:       "missing fields",
+			body:       job(map[string]any{"image_url": []string{}}),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{
+				"visits[0].store_id required",
+				"visits[0].visit_time required",
+				"visits[0].image_url required",
+			},
+		},
+		{
+			name: "invalid visit time",
+			body: job(map[string]any{
+				"store_id":   "S1",
+				"visit_time": "yesterday",
+				"image_url":  []string{png},
+			}),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{"visits[0].visit_time invalid_time"},
+		},
+		{
+			name:       "invalid urls",
+			body:       job(visit("S1", "not a url", "ftp://example.com/a.png", png, png)),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{
+				"visits[0].image_url[0] invalid_url",
+				"visits[0].image_url[1] unsupported_scheme",
+				"visits[0].image_url[3] duplicate",
+			},
+		},
+		{
+			name: "callback without a webhook secret",
+			body: map[string]any{
+				"count":        1,
+				"visits":       []any{visit("S1", png)},
+				"callback_url": "https://example.com/hook",
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{"callback_url callbacks_disabled"},
+		},
+		{
+			name:           "unknown stores",
+			body:           job(visit("S1", png), visit("S9", images.url(fixturePNG, "2")), visit("S9", images.url(fixturePNG, "3"))),
+			wantStatus:     http.StatusUnprocessableEntity,
+			wantErrors:     []string{"visits[1].store_id unknown_store", "visits[2].store_id unknown_store"},
+			wantUnknownIDs: []string{"S9"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res struct {
+				Error  string `json:"error"`
+				Errors []struct {
+					Path string `json:"path"`
+					Code string `json:"code"`
+				} `json:"errors"`
+				UnknownStoreIDs []string `json:"unknown_store_ids"`
+			}
+
+			resp := ta.do(http.MethodPost, "/api/submit", tt.body, nil, &res)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			if !strings.Contains(res.Error, tt.wantErrorSubstr) {
+				t.Errorf("got error %q, want it to contain %q", res.Error, tt.wantErrorSubstr)
+			}
+
+			var got []string
+			for _, e := range res.Errors {
+				got = append(got, e.Path+" "+e.Code)
+			}
+			if !slices.Equal(got, tt.wantErrors) {
+				t.Errorf("got errors %q, want %q", got, tt.wantErrors)
+			}
+
+			if !slices.Equal(res.UnknownStoreIDs, tt.wantUnknownIDs) {
+				t.Errorf("got unknown store IDs %q, want %q", res.UnknownStoreIDs, tt.wantUnknownIDs)
+			}
+		})
+	}
+
+	// rejected submissions create no job
+	stored, err := ta.Jobs.FindStoresVisits(context.Background(), service.JobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 0 {
+		t.Errorf("got %d jobs, want none", len(stored))
+	}
+	if hits := images.hitCount(fixturePNG, ""); hits != 0 {
+		t.Errorf("got %d downloads, want none", hits)
+	}
+}
+
+func TestProcessingFailures(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, nil)
+
+	tests := []struct {
+		fixture   string
+		wantError string
+	}{
+		{fixtureMissing, "received status code 404"},
+		{fixtureSlow, "context deadline exceeded"},
+		{fixtureTruncated, "unexpected EOF"},
+		{fixtureOversized, "image is larger than 1048576 bytes"},
+		{fixtureStreamed, "image is larger than 1048576 bytes"},
+		{fixtureCorrupt, "failed to decode image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.TrimPrefix(tt.fixture, "/img/"), func(t *testing.T) {
+			// the first visit succeeds, the failing image is in the second one
+			resp, id := ta.submit(job(
+				visit("S1", images.url(fixturePNG, tt.fixture)),
+				visit("S2", images.url(fixtureJPEG, tt.fixture), images.url(tt.fixture, ""), images.url(fixturePNG, tt.fixture+"-after")),
+			))
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+
+			status := ta.waitForJob(id)
+			if status.Status != "failed" || status.Error == nil {
+				t.Fatalf("job ended %q with error %+v, want failed", status.Status, status.Error)
+			}
+			if status.Error.StoreID != "S2" {
+				t.Errorf("got failed store %q, want S2", status.Error.StoreID)
+			}
+			if !strings.Contains(status.Error.Error, tt.wantError) {
+				t.Errorf("got error %q, want it to contain %q", status.Error.Error, tt.wantError)
+			}
+
+			// the job stops at the failing image
+			if hits := images.hitCount(fixturePNG, tt.fixture+"-after"); hits != 0 {
+				t.Errorf("image after the failure downloaded %d times", hits)
+			}
+
+			var res jobResult
+			ta.do(http.MethodGet, "/api/jobs/"+id, nil, nil, &res)
+			if res.Status != "failed" || len(res.Visits) != 2 {
+				t.Fatalf("unexpected result %+v", res)
+			}
+			if got := res.Visits[0].Images[0].Perimeter; got != 12 {
+				t.Errorf("got perimeter %d for the completed visit, want 12", got)
+			}
+		})
+	}
+}
+
+func TestURLPolicy(t *testing.T) {
+	images := newImageServer(t)
+	_, port, _ := strings.Cut(strings.TrimPrefix(images.URL, "http://"), ":")
+
+	strict := func(cfg *config.Config) {
+		cfg.Fetch.AllowPrivateNetworks = false
+		cfg.Fetch.DeniedHosts = []string{"*.internal.test"}
+		cfg.Webhook.Secret = "test-secret"
+	}
+
+	t.Run("rejected when submitted", func(t *testing.T) {
+		ta := startApp(t, nil, strict)
+
+		var res struct {
+			Errors []struct {
+				Path string `json:"path"`
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+
+		body := job(visit("S1",
+			"http://169.254.169.254/latest/meta-data/",
+			images.url(fixturePNG, ""),
+			"http://[::ffff:10.0.0.1]/a.png",
+			"http://images.internal.test/a.png",
+			"http://IMAGES.internal.test./b.png",
+			"https://images.example.com/a.png",
+		))
+		body["callback_url"] = "http://10.0.0.1/hook"
+
+		resp := ta.do(http.MethodPost, "/api/submit", body, nil, &res)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+		}
+
+		var got []string
+		for _, e := range res.Errors {
+			got = append(got, e.Path+" "+e.Code)
+		}
+		want := []string{
+			"callback_url blocked_address",
+			"visits[0].image_url[0] blocked_address",
+			"visits[0].image_url[1] blocked_address",
+			"visits[0].image_url[2] blocked_address",
+			"visits[0].image_url[3] host_not_allowed",
+			"visits[0].image_url[4] host_not_allowed",
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("got errors %q, want %q", got, want)
+		}
+	})
+
+	t.Run("scheme not allowed", func(t *testing.T) {
+		ta := startApp(t, nil, func(cfg *config.Config) {
+			cfg.Fetch.AllowedSchemes = []string{"https"}
+		})
+
+		var res struct {
+			Errors []struct {
+				Path string `json:"path"`
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+
+		resp := ta.do(http.MethodPost, "/api/submit", job(visit("S1", images.url(fixturePNG, ""))), nil, &res)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+		}
+		if len(res.Errors) != 1 || res.Errors[0].Path != "visits[0].image_url[0]" || res.Errors[0].Code != "unsupported_scheme" {
+			t.Errorf("got errors %+v, want visits[0].image_url[0] unsupported_scheme", res.Errors)
+		}
+	})
+
+	t.Run("blocked once resolved", func(t *testing.T) {
+		ta := startApp(t, nil, strict)
+
+		// the host name passes validation, its address is only known when connecting
+		resp, id := ta.submit(job(visit("S1", "http://localhost:"+port+fixturePNG+"?resolved")))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+
+		status := ta.waitForJob(id)
+		if status.Status != "failed" || status.Error == nil || !strings.Contains(status.Error.Error, "is not allowed, it is loopback") {
+			t.Fatalf("job ended %q with error %+v, want failed on a loopback address", status.Status, status.Error)
+		}
+		if hits := images.hitCount(fixturePNG, "resolved"); hits != 0 {
+			t.Errorf("image downloaded %d times", hits)
+		}
+	})
+
+	t.Run("callback blocked once resolved", func(t *testing.T) {
+		ta := startApp(t, nil, func(cfg *config.Config) {
+			strict(cfg)
+			cfg.Webhook.MaxAttempts = 1
+		})
+
+		body := job(visit("S1", "http://localhost:"+port+fixturePNG+"?callback"))
+		body["callback_url"] = "http://localhost:" + port + "/hook"
+
+		resp, id := ta.submit(body)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+		ta.waitForJob(id)
+
+		// the callback is posted after the job is finished
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var status struct {
+				CallbackAttempts []struct {
+					Error     string `json:"error"`
+					Delivered bool   `json:"delivered"`
+				} `json:"callback_attempts"`
+			}
+			ta.do(http.MethodGet, "/api/status?jobid="+id, nil, nil, &status)
+
+			if len(status.CallbackAttempts) > 0 {
+				attempt := status.CallbackAttempts[0]
+				if attempt.Delivered || !strings.Contains(attempt.Error, "is not allowed, it is loopback") {
+					t.Errorf("got callback attempt %+v, want it blocked on a loopback address", attempt)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("callback never attempted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if hits := images.hitCount("/hook", ""); hits != 0 {
+			t.Errorf("callback posted %d times", hits)
+		}
+	})
+
+	t.Run("callback delivered", func(t *testing.T) {
+		type delivery struct {
+			signature string
+			body      []byte
+		}
+		deliveries := make(chan delivery, 1)
+		hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			deliveries <- delivery{signature: r.Header.Get(webhook.SignatureHeader), body: body}
+		}))
+		defer hook.Close()
+
+		ta := startApp(t, nil, func(cfg *config.Config) {
+			cfg.Webhook.Secret = "test-secret"
+		})
+
+		body := job(visit("S1", images.url(fixturePNG, "callback-delivered")))
+		body["callback_url"] = hook.URL + "/hook"
+
+		_, id := ta.submit(body)
+		ta.waitForJob(id)
+
+		var got delivery
+		select {
+		case got = <-deliveries:
+		case <-time.After(10 * time.Second):
+			t.Fatal("callback never delivered")
+		}
+
+		if want := "sha256=" + webhook.Sign([]byte("test-secret"), got.body); got.signature != want {
+			t.Errorf("got signature %q, want %q", got.signature, want)
+		}
+
+		var payload webhook.Payload
+		if err := json.Unmarshal(got.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.JobID != id || payload.Status != "completed" || payload.Summary.ImagesProcessed != 1 || payload.Summary.ImagesTotal != 1 {
+			t.Errorf("unexpected payload %+v", payload)
+		}
+
+		// the attempt is recorded once the response is read
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var status struct {
+				CallbackAttempts []struct {
+					Attempt    int  `json:"attempt"`
+					StatusCode int  `json:"status_code"`
+					Delivered  bool `json:"delivered"`
+				} `json:"callback_attempts"`
+			}
+			ta.do(http.MethodGet, "/api/status?jobid="+id, nil, nil, &status)
+
+			if len(status.CallbackAttempts) > 0 {
+				attempt := status.CallbackAttempts[0]
+				if len(status.CallbackAttempts) != 1 || !attempt.Delivered || attempt.StatusCode != http.StatusOK || attempt.Attempt != 1 {
+					t.Errorf("got callback attempts %+v, want one delivered", status.CallbackAttempts)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("callback attempt never recorded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("redirects", func(t *testing.T) {
+		ta := startApp(t, nil, func(cfg *config.Config) {
+			cfg.Fetch.MaxRedirects = 2
+			cfg.Fetch.DeniedHosts = []string{"denied.test"}
+		})
+
+		redirect := func(hops int, to string) string {
+			query := url.Values{"hops": {strconv.Itoa(hops)}}
+			if to != "" {
+				query.Set("to", to)
+			}
+			return images.url(fixtureRedirect, query.Encode())
+		}
+
+		tests := []struct {
+			name      string
+			url       string
+			wantError string
+		}{
+			{"within the limit", redirect(2, ""), ""},
+			{"over the limit", redirect(3, ""), "stopped after 2 redirects"},
+			{"to a denied host", redirect(1, "http://denied.test/a.png"), "host denied.test is not allowed"},
+			{"to the metadata service", redirect(1, "http://169.254.169.254/latest/meta-data/"), "address 169.254.169.254 is not allowed, it is link-local"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				resp, id := ta.submit(job(visit("S1", tt.url)))
+				if resp.StatusCode != http.StatusCreated {
+					t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+				}
+
+				status := ta.waitForJob(id)
+
+				if tt.wantError == "" {
+					if status.Status != "completed" {
+						t.Fatalf("job ended %q with error %+v, want completed", status.Status, status.Error)
+					}
+					return
+				}
+
+				if status.Status != "failed" || status.Error == nil || !strings.Contains(status.Error.Error, tt.wantError) {
+					t.Fatalf("job ended %q with error %+v, want failed with %q", status.Status, status.Error, tt.wantError)
+				}
+			})
+		}
+	})
+}
+
+func TestUnknownStoreFailsJobWithLazyCheck(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, func(cfg *config.Config) {
+		cfg.Stores.LazyCheck = true
+	})
+
+	resp, id := ta.submit(job(visit("S9", images.url(fixturePNG, ""))))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	status := ta.waitForJob(id)
+	if status.Status != "failed" || status.Error == nil || status.Error.StoreID != "S9" || status.Error.Error != "store ID does not exist" {
+		t.Fatalf("job ended %q with error %+v, want failed on S9", status.Status, status.Error)
+	}
+	if hits := images.hitCount(fixturePNG, ""); hits != 0 {
+		t.Errorf("got %d downloads, want none", hits)
+	}
+}
+
+func TestResumeOngoingJob(t *testing.T) {
+	images := newImageServer(t)
+
+	// a job interrupted after the first image of its first visit
+	jobs := service.NewMemoryJobRepository()
+	id, err := jobs.InsertStoresVisit(context.Background(), model.StoresVisit{
+		Status: "ongoing",
+		Count:  2,
+		Visits: []model.VisitInfo{
+			{
+				StoreID:    "S1",
+				VisitTime:  time.Date(2024, 11, 16, 10, 30, 0, 0, time.UTC),
+				ImageURLs:  []string{images.url(fixturePNG, "done"), images.url(fixtureJPEG, "")},
+				ImageUUIDs: []string{"processed-before.png"},
+				Perimeters: []int64{12},
+			},
+			{
+				StoreID:   "S2",
+				VisitTime: time.Date(2024, 11, 16, 11, 30, 0, 0, time.UTC),
+				ImageURLs: []string{images.url(fixturePNG, "todo")},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta := startApp(t, jobs, nil)
+
+	status := ta.waitForJob(id.Hex())
+	if status.Status != "completed" {
+		t.Fatalf("job ended %q with error %+v, want completed", status.Status, status.Error)
+	}
+
+	// images processed before the interruption are not downloaded again
+	for _, tt := range []struct {
+		fixture, query string
+		want           int
+	}{
+		{fixturePNG, "done", 0},
+		{fixtureJPEG, "", 1},
+		{fixturePNG, "todo", 1},
+	} {
+		if got := images.hitCount(tt.fixture, tt.query); got != tt.want {
+			t.Errorf("%s?%s downloaded %d times, want %d", tt.fixture, tt.query, got, tt.want)
+		}
+	}
+
+	var res jobResult
+	ta.do(http.MethodGet, "/api/jobs/"+id.Hex(), nil, nil, &res)
+
+	if got := res.Visits[0].Images[0].ImageID; got != "processed-before.png" {
+		t.Errorf("got image id %q for the image processed before, want it kept", got)
+	}
+	if got := res.Visits[0].Images[1].Perimeter; got != 35 {
+		t.Errorf("got perimeter %d, want 35", got)
+	}
+	if got := res.Visits[1].Images[0].Perimeter; got != 12 {
+		t.Errorf("got perimeter %d, want 12", got)
+	}
+	if got := res.Visits[1].StoreName; got != "Second Store" {
+		t.Errorf("got store name %q, want Second Store", got)
+	}
+}
+
+// failingJobs fails the writes of a job a given number of times
+type failingJobs struct {
+	*service.MemoryJobRepository
+
+	mu                 sync.Mutex
+	visitFailures      int
+	statusFailures     int
+	releaseFailures    int
+	statusUpdatesTried int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (f *failingJobs) UpdateVisitInfo(ctx context.Context, id primitive.ObjectID, visitIndex int, perims []int64, uuids []string, storeInfo model.Store) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.visitFailures > 0 {
+		f.visitFailures--
+		return errWriteFailed
+	}
+	return f.MemoryJobRepository.UpdateVisitInfo(ctx, id, visitIndex, perims, uuids, storeInfo)
+}
+
+func (f *failingJobs) ReleaseLeases(ctx context.Context, owner string, ids ...primitive.ObjectID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.releaseFailures > 0 {
+		f.releaseFailures--
+		return errWriteFailed
+	}
+	return f.MemoryJobRepository.ReleaseLeases(ctx, owner, ids...)
+}
+
+func (f *failingJobs) UpdateStoresVisitStatus(ctx context.Context, id primitive.ObjectID, status, errMssg, failedStoreID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.statusUpdatesTried++
+	if f.statusFailures > 0 {
+		f.statusFailures--
+		return errWriteFailed
+	}
+	return f.MemoryJobRepository.UpdateStoresVisitStatus(ctx, id, status, errMssg, failedStoreID)
+}
+
+func TestJobWriteFailures(t *testing.T) {
+	images := newImageServer(t)
+
+	t.Run("progress not saved", func(t *testing.T) {
+		jobs := &failingJobs{MemoryJobRepository: service.NewMemoryJobRepository(), visitFailures: 1}
+		ta := startApp(t, jobs, nil)
+
+		_, id := ta.submit(job(visit("S1", images.url(fixturePNG, "progress"))))
+
+		status := ta.waitForJob(id)
+		if status.Status != "failed" || status.Error == nil {
+			t.Fatalf("job ended %q with error %+v, want failed", status.Status, status.Error)
+		}
+		if !strings.Contains(status.Error.Error, "failed to save the processed images") || status.Error.StoreID != "S1" {
+			t.Errorf("got error %+v, want the processed images of S1 not saved", status.Error)
+		}
+	})
+
+	t.Run("status not saved", func(t *testing.T) {
+		jobs := &failingJobs{MemoryJobRepository: service.NewMemoryJobRepository(), statusFailures: 1}
+		ta := startApp(t, jobs, func(cfg *config.Config) {
+			cfg.Jobs.LeaseTTL = 150 * time.Millisecond
+		})
+
+		_, id := ta.submit(job(visit("S1", images.url(fixturePNG, "status"))))
+
+		// the job is released and resumed, the image saved the first time is
+		// not downloaded again
+		if status := ta.waitForJob(id); status.Status != "completed" {
+			t.Fatalf("job ended %q with error %+v, want completed", status.Status, status.Error)
+		}
+		if hits := images.hitCount(fixturePNG, "status"); hits != 1 {
+			t.Errorf("image downloaded %d times, want once", hits)
+		}
+
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+		if jobs.statusUpdatesTried != 2 {
+			t.Errorf("status saved in %d tries, want 2", jobs.statusUpdatesTried)
+		}
+	})
+
+	t.Run("status and lease release not saved", func(t *testing.T) {
+		jobs := &failingJobs{MemoryJobRepository: service.NewMemoryJobRepository(), statusFailures: 1, releaseFailures: 1}
+		ta := startApp(t, jobs, func(cfg *config.Config) {
+			cfg.Jobs.LeaseTTL = 150 * time.Millisecond
+		})
+
+		_, id := ta.submit(job(visit("S1", images.url(fixturePNG, "released"))))
+
+		// the lease expires as it is no longer renewed, and the job is resumed
+		// by the same instance
+		if status := ta.waitForJob(id); status.Status != "completed" {
+			t.Fatalf("job ended %q with error %+v, want completed", status.Status, status.Error)
+		}
+		if hits := images.hitCount(fixturePNG, "released"); hits != 1 {
+			t.Errorf("image downloaded %d times, want once", hits)
+		}
+
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+		if jobs.statusUpdatesTried != 2 {
+			t.Errorf("status saved in %d tries, want 2", jobs.statusUpdatesTried)
+		}
+	})
+}
+
+func TestResumeOnlyUnleasedJobs(t *testing.T) {
+	images := newImageServer(t)
+
+	jobs := service.NewMemoryJobRepository()
+	insert := func(query string, leaseExpiresAt time.Time) string {
+		t.Helper()
+
+		id, err := jobs.InsertStoresVisit(context.Background(), model.StoresVisit{
+			Status: "ongoing",
+			Count:  1,
+			Visits: []model.VisitInfo{{
+				StoreID:   "S1",
+				VisitTime: time.Date(2024, 11, 16, 10, 30, 0, 0, time.UTC),
+				ImageURLs: []string{images.url(fixturePNG, query)},
+			}},
+			LeaseOwner:     "other-replica",
+			LeaseExpiresAt: leaseExpiresAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id.Hex()
+	}
+
+	// held by a replica still running, one that stopped a while ago, and one
+	// that stops renewing its lease shortly
+	held := insert("held", time.Now().Add(time.Hour))
+	expired := insert("expired", time.Now().Add(-time.Minute))
+	expiring := insert("expiring", time.Now().Add(300*time.Millisecond))
+
+	ta := startApp(t, jobs, func(cfg *config.Config) {
+		cfg.Jobs.LeaseTTL = 150 * time.Millisecond
+	})
+
+	for _, id := range []string{expired, expiring} {
+		if status := ta.waitForJob(id); status.Status != "completed" {
+			t.Fatalf("job %s ended %q with error %+v, want completed", id, status.Status, status.Error)
+		}
+	}
+
+	var status jobStatus
+	ta.do(http.MethodGet, "/api/status?jobid="+held, nil, nil, &status)
+	if status.Status != "ongoing" {
+		t.Errorf("job held by another replica is %q, want it left ongoing", status.Status)
+	}
+	if hits := images.hitCount(fixturePNG, "held"); hits != 0 {
+		t.Errorf("job held by another replica downloaded %d times", hits)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, func(cfg *config.Config) {
+		// the gated images wait for the test
+		cfg.Timeouts.Download = 10 * time.Second
+	})
+
+	_, id := ta.submit(job(
+		visit("S1", images.url(fixtureGated, "1"), images.url(fixtureGated, "2")),
+		visit("S2", images.url(fixtureGated, "3")),
+	))
+
+	stream := ta.stream(id)
+
+	snapshot := stream.next()
+	if snapshot.Type != events.TypeProgress || snapshot.JobID != id || snapshot.ImagesProcessed != 0 || snapshot.ImagesTotal != 3 || snapshot.VisitsTotal != 2 {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+
+	images.open(3)
+
+	var got []string
+	for _, ev := range stream.rest() {
+		got = append(got, fmt.Sprintf("%s %s %d", ev.Type, ev.StoreID, ev.ImagesProcessed))
+	}
+	want := []string{"progress S1 1", "progress S1 2", "progress S2 3", "completed  3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	// a finished job only sends its terminal event
+	if rest := ta.stream(id).rest(); len(rest) != 1 || rest[0].Type != events.TypeCompleted || rest[0].ImagesProcessed != 3 {
+		t.Errorf("got events %+v for the finished job, want the completed event", rest)
+	}
+}
+
+func TestEventStreamJoinedMidJob(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, func(cfg *config.Config) {
+		cfg.Timeouts.Download = 10 * time.Second
+	})
+
+	_, id := ta.submit(job(
+		visit("S1", images.url(fixtureGated, "1"), images.url(fixtureGated, "2")),
+		visit("S2", images.url(fixtureGated, "3"), images.url(fixtureGated, "4")),
+	))
+
+	first := ta.stream(id)
+	first.next()
+
+	// the first visit is stored, the first image of the second one is only
+	// known from its event
+	images.open(3)
+	for want := 1; want <= 3; want++ {
+		if ev := first.next(); ev.ImagesProcessed != want {
+			t.Fatalf("got %d images processed, want %d", ev.ImagesProcessed, want)
+		}
+	}
+
+	second := ta.stream(id)
+	if snapshot := second.next(); snapshot.Type != events.TypeProgress || snapshot.ImagesProcessed != 3 || snapshot.StoreID != "S2" {
+		t.Fatalf("got snapshot %+v, want 3 images processed in S2", snapshot)
+	}
+
+	images.open(1)
+
+	for name, stream := range map[string]*eventStream{"first": first, "second": second} {
+		var got []string
+		for _, ev := range stream.rest() {
+			got = append(got, fmt.Sprintf("%s %d", ev.Type, ev.ImagesProcessed))
+		}
+		if want := []string{"progress 4", "completed 4"}; !slices.Equal(got, want) {
+			t.Errorf("%s stream: got events %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStatusAndResultErrors(t *testing.T) {
+	ta := startApp(t, nil, nil)
+
+	unknown := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantError  string
+	}{
+		{"status without id", "/api/status", http.StatusBadRequest, "jobd is a required field"},
+		{"status with invalid id", "/api/status?jobid=nope", http.StatusBadRequest, "invalid jobid"},
+		{"status of unknown job", "/api/status?jobid=" + unknown, http.StatusBadRequest, "jobid does not exist"},
+		{"result with invalid id", "/api/jobs/nope", http.StatusBadRequest, "invalid jobid"},
+		{"result of unknown job", "/api/jobs/" + unknown, http.StatusNotFound, "jobid does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res struct {
+				Error string `json:"error"`
+			}
+
+			resp := ta.do(http.MethodGet, tt.path, nil, nil, &res)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if res.Error != tt.wantError {
+				t.Errorf("got error %q, want %q", res.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestIdempotentSubmit(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, nil)
+
+	header := http.Header{"Idempotency-Key": []string{"submit-1"}}
+	body := job(visit("S1", images.url(fixturePNG, "")))
+
+	var first, replay struct {
+		JobID string `json:"job_id"`
+	}
+
+	resp := ta.do(http.MethodPost, "/api/submit", body, header, &first)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	resp = ta.do(http.MethodPost, "/api/submit", body, header, &replay)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replay: got status %d, want a replayed %d", resp.StatusCode, http.StatusOK)
+	}
+	if replay.JobID != first.JobID {
+		t.Errorf("replay returned job %s, want %s", replay.JobID, first.JobID)
+	}
+
+	other := job(visit("S2", images.url(fixturePNG, "")))
+	if resp := ta.do(http.MethodPost, "/api/submit", other, header, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("reuse with another body: got status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	ta.waitForJob(first.JobID)
+	if hits := images.hitCount(fixturePNG, ""); hits != 1 {
+		t.Errorf("image downloaded %d times, want once", hits)
+	}
+}
+
+func TestIsolatedApps(t *testing.T) {
+	images := newImageServer(t)
+	first := startApp(t, nil, nil)
+	second := startApp(t, nil, nil)
+
+	_, id := first.submit(job(visit("S1", images.url(fixturePNG, ""))))
+	first.waitForJob(id)
+
+	// the job only exists in the app it was submitted to
+	if resp := second.do(http.MethodGet, "/api/jobs/"+id, nil, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second app: got status %d for the job of the first, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if waits := second.Clock.Waits(); len(waits) != 0 {
+		t.Errorf("second app processed %d images, want none", len(waits))
+	}
+}
+
+func TestAdminEndpointsWithoutAuth(t *testing.T) {
+	ta := startApp(t, nil, nil)
+
+	for _, tt := range []struct{ method, path string }{
+		{http.MethodGet, "/api/admin/log-level"},
+		{http.MethodPost, "/api/admin/stores/reload"},
+		{http.MethodGet, "/api/admin/keys"},
+	} {
+		if resp := ta.do(tt.method, tt.path, nil, nil, nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	images := newImageServer(t)
+
+	ta := startApp(t, nil, func(cfg *config.Config) {
+		cfg.Auth.Enabled = true
+		cfg.Auth.BootstrapKey = bootstrapKey
+	})
+
+	admin := http.Header{"X-Api-Key": []string{bootstrapKey}}
+
+	acme, _ := ta.createAPIKey(admin, map[string]any{"owner": "acme"})
+	globex, globexKeyID := ta.createAPIKey(admin, map[string]any{"owner": "globex"})
+
+	submit := func(header http.Header, query string) string {
+		t.Helper()
+
+		var res struct {
+			JobID string `json:"job_id"`
+		}
+		resp := ta.do(http.MethodPost, "/api/submit", job(visit("S1", images.url(fixturePNG, query))), header, &res)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("submit: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+		return res.JobID
+	}
+
+	acmeJob := submit(acme, "acme")
+	globexJob := submit(globex, "globex")
+
+	for _, tt := range []struct {
+		name       string
+		method     string
+		path       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"probe without key", http.MethodGet, "/healthz", nil, http.StatusOK},
+		{"no key", http.MethodGet, "/api/jobs", nil, http.StatusUnauthorized},
+		{"unknown key", http.MethodGet, "/api/jobs", http.Header{"X-Api-Key": []string{"ijp_unknown"}}, http.StatusUnauthorized},
+		{"own job", http.MethodGet, "/api/jobs/" + acmeJob, acme, http.StatusOK},
+		{"own status", http.MethodGet, "/api/status?jobid=" + acmeJob, acme, http.StatusOK},
+		{"job of another client", http.MethodGet, "/api/jobs/" + globexJob, acme, http.StatusNotFound},
+		{"status of another client", http.MethodGet, "/api/status?jobid=" + globexJob, acme, http.StatusBadRequest},
+		{"jobs of another client", http.MethodGet, "/api/jobs?owner=globex", acme, http.StatusForbidden},
+		{"admin endpoint", http.MethodGet, "/api/admin/keys", acme, http.StatusForbidden},
+		{"admin reads any job", http.MethodGet, "/api/jobs/" + globexJob, admin, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := ta.do(tt.method, tt.path, nil, tt.header, nil); resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	listJobs := func(header http.Header, query string) []string {
+		t.Helper()
+
+		var res struct {
+			Jobs []struct {
+				JobID string `json:"job_id"`
+				Owner string `json:"owner"`
+			} `json:"jobs"`
+		}
+		if resp := ta.do(http.MethodGet, "/api/jobs"+query, nil, header, &res); resp.StatusCode != http.StatusOK {
+			t.Fatalf("list jobs: got status %d", resp.StatusCode)
+		}
+
+		var ids []string
+		for _, j := range res.Jobs {
+			ids = append(ids, j.Owner+" "+j.JobID)
+		}
+		return ids
+	}
+
+	if got, want := listJobs(acme, ""), []string{"acme " + acmeJob}; !slices.Equal(got, want) {
+		t.Errorf("acme lists %q, want %q", got, want)
+	}
+	if got, want := listJobs(admin, ""), []string{"globex " + globexJob, "acme " + acmeJob}; !slices.Equal(got, want) {
+		t.Errorf("admin lists %q, want %q", got, want)
+	}
+	if got, want := listJobs(admin, "?owner=globex"), []string{"globex " + globexJob}; !slices.Equal(got, want) {
+		t.Errorf("admin lists %q for globex, want %q", got, want)
+	}
+
+	// Idempotency-Keys of different clients do not collide
+	idempotent := func(header http.Header) http.Header {
+		h := header.Clone()
+		h.Set("Idempotency-Key", "same-key")
+		return h
+	}
+	acmeReplayed := submit(idempotent(acme), "idempotent-acme")
+	if globexReplayed := submit(idempotent(globex), "idempotent-globex"); globexReplayed == acmeReplayed {
+		t.Errorf("globex got the job of acme for the same Idempotency-Key")
+	}
+
+	// a revoked key is rejected
+	if resp := ta.do(http.MethodDelete, "/api/admin/keys/"+globexKeyID, nil, admin, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke key: got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp := ta.do(http.MethodGet, "/api/jobs", nil, globex, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked key: got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	for _, id := range []string{acmeJob, globexJob, acmeReplayed} {
+		ta.waitForJobAs(id, admin)
+	}
+}
+
+func TestSubmissionLimits(t *testing.T) {
+	images := newImageServer(t)
+	ta := startApp(t, nil, func(cfg *config.Config) {
+		cfg.Auth.Enabled = true
+		cfg.Auth.BootstrapKey = bootstrapKey
+	})
+
+	admin := http.Header{"X-Api-Key": []string{bootstrapKey}}
+
+	// every key gets a single limit, to test them apart
+	keyWithLimits := func(owner string, limits map[string]int) (http.Header, primitive.ObjectID) {
+		t.Helper()
+
+		header, id := ta.createAPIKey(admin, map[string]any{"owner": owner, "limits": limits})
+		keyID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header, keyID
+	}
+
+	// storeJob stores a job of the key as if it had been submitted with it,
+	// without processing it
+	storeJob := func(keyID primitive.ObjectID, status string, imageCount int) {
+		t.Helper()
+
+		urls := make([]string, imageCount)
+		for i := range urls {
+			urls[i] = images.url(fixturePNG, "stored-"+strconv.Itoa(i))
+		}
+
+		_, err := ta.Jobs.InsertStoresVisit(context.Background(), model.StoresVisit{
+			Status:   status,
+			Count:    1,
+			Visits:   []model.VisitInfo{{StoreID: "S1", ImageURLs: urls}},
+			APIKeyID: keyID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	submitAs := func(header http.Header, body any) *http.Response {
+		t.Helper()
+		return ta.do(http.MethodPost, "/api/submit", body, header, nil)
+	}
+
+	wantTooManyRequests := func(resp *http.Response, maxRetryAfter int) {
+		t.Helper()
+
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+		}
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || retryAfter < 1 || retryAfter > maxRetryAfter {
+			t.Errorf("got Retry-After %q, want between 1 and %d", resp.Header.Get("Retry-After"), maxRetryAfter)
+		}
+	}
+
+	t.Run("requests per minute", func(t *testing.T) {
+		header, _ := keyWithLimits("rate", map[string]int{"requests_per_minute": 2})
+
+		// rejected submissions count too
+		for range 2 {
+			if resp := submitAs(header, `{`); resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		}
+
+		wantTooManyRequests(submitAs(header, job(visit("S1", images.url(fixturePNG, "rate")))), 60)
+	})
+
+	t.Run("images per job", func(t *testing.T) {
+		header, _ := keyWithLimits("big-jobs", map[string]int{"images_per_job": 2})
+
+		var res struct {
+			Errors []struct {
+				Path string `json:"path"`
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+		body := job(visit("S1", images.url(fixturePNG, "a"), images.url(fixturePNG, "b")), visit("S2", images.url(fixturePNG, "c")))
+		resp := ta.do(http.MethodPost, "/api/submit", body, header, &res)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+		}
+		if len(res.Errors) != 1 || res.Errors[0].Path != "visits" || res.Errors[0].Code != "too_many_images" {
+			t.Errorf("got errors %+v, want too_many_images on visits", res.Errors)
+		}
+	})
+
+	t.Run("active jobs", func(t *testing.T) {
+		header, keyID := keyWithLimits("busy", map[string]int{"active_jobs": 1})
+		storeJob(keyID, "ongoing", 1)
+
+		wantTooManyRequests(submitAs(header, job(visit("S1", images.url(fixturePNG, "busy")))), 10)
+	})
+
+	t.Run("images per day", func(t *testing.T) {
+		header, keyID := keyWithLimits("daily", map[string]int{"images_per_day": 3})
+		storeJob(keyID, "completed", 2)
+
+		body := job(visit("S1", images.url(fixturePNG, "daily-a"), images.url(fixturePNG, "daily-b")))
+		wantTooManyRequests(submitAs(header, body), 24*60*60)
+
+		var submitted struct {
+			JobID string `json:"job_id"`
+		}
+		resp := ta.do(http.MethodPost, "/api/submit", job(visit("S1", images.url(fixturePNG, "daily-c"))), header, &submitted)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("the last image of the day: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+		ta.waitForJobAs(submitted.JobID, header)
+
+		var usage struct {
+			Limits struct {
+				ImagesPerDay int `json:"images_per_day"`
+			} `json:"limits"`
+			Usage struct {
+				RequestsThisMinute int   `json:"requests_this_minute"`
+				ActiveJobs         int64 `json:"active_jobs"`
+				ImagesToday        int64 `json:"images_today"`
+			} `json:"usage"`
+		}
+		if resp := ta.do(http.MethodGet, "/api/usage", nil, header, &usage); resp.StatusCode != http.StatusOK {
+			t.Fatalf("usage: got status %d", resp.StatusCode)
+		}
+		if usage.Limits.ImagesPerDay != 3 || usage.Usage.ImagesToday != 3 || usage.Usage.ActiveJobs != 0 {
+			t.Errorf("got usage %+v", usage)
+		}
+	})
+
+	t.Run("admin keys are not limited", func(t *testing.T) {
+		var res struct {
+			Limits *struct{} `json:"limits"`
+		}
+		if resp := ta.do(http.MethodGet, "/api/usage", nil, admin, &res); resp.StatusCode != http.StatusOK || res.Limits != nil {
+			t.Errorf("got status %d and limits %v for an admin key", resp.StatusCode, res.Limits)
+		}
+	})
+}
+
+func TestStoreMasterWithByteOrderMark(t *testing.T) {
+	ta := startApp(t, nil, func(cfg *config.Config) {
+		// as saved by spreadsheet programs, with a mark before the quoted header
+		csv := "\ufeff\"StoreID\",\"StoreName\",\"AreaCode\"\n\"S7\",\"Seventh Store\",\"A7\"\n"
+		cfg.Stores.CSVPath = filepath.Join(t.TempDir(), "stores.csv")
+		if err := os.WriteFile(cfg.Stores.CSVPath, []byte(csv), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var st struct {
+		Name string `json:"store_name"`
+	}
+	resp := ta.do(http.MethodGet, "/api/stores/S7", nil, nil, &st)
+	if resp.StatusCode != http.StatusOK || st.Name != "Seventh Store" {
+		t.Fatalf("got status %d and store %+v, want Seventh Store", resp.StatusCode, st)
+	}
+}
+
+func TestMongoURIRequired(t *testing.T) {
+	t.Run("csv store source", func(t *testing.T) {
+		cfg := config.Default()
+		cfg.Stores.Source = "csv"
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("configuration without mongo.uri refused: %v", err)
+		}
+
+		// the jobs are still stored in MongoDB unless replaced
+		_, err := app.New(context.Background(), cfg, app.Options{Logger: logger.Discard()})
+		if err == nil || !strings.Contains(err.Error(), "mongo.uri") {
+			t.Errorf("got error %v, want mongo.uri required", err)
+		}
+	})
+
+	t.Run("mongo store source", func(t *testing.T) {
+		cfg := config.Default()
+		cfg.Stores.Source = "mongo"
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "mongo.uri") {
+			t.Errorf("got error %v, want mongo.uri required", err)
+		}
+	})
+}
@@ -0,0 +1,566 @@
+package app_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image-job-processor/internal/app"
+	"image-job-processor/internal/config"
+	"image-job-processor/internal/events"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/service"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fixtures served by the image server
+const (
+	fixturePNG       = "/img/png"       // 3x4 PNG, perimeter 12
+	fixtureJPEG      = "/img/jpeg"      // 5x7 JPEG, perimeter 35
+	fixtureMissing   = "/img/missing"   // 404
+	fixtureSlow      = "/img/slow"      // answers after the download timeout
+	fixtureTruncated = "/img/truncated" // PNG cut short of its Content-Length
+	fixtureOversized = "/img/oversized" // larger than the size limit, with a Content-Length
+	fixtureStreamed  = "/img/streamed"  // larger than the size limit, without a Content-Length
+	fixtureCorrupt   = "/img/corrupt"   // not an image
+	fixtureRedirect  = "/img/redirect"  // redirects ?hops times, then to ?to or fixturePNG
+	fixtureGated     = "/img/gated"     // fixturePNG once let through by imageServer.open
+)
+
+// maxImageSizeMB is the image size limit of the test apps
+const maxImageSizeMB = 1
+
+// downloadTimeout is the download timeout of the test apps, fixtureSlow takes longer
+const downloadTimeout = 250 * time.Millisecond
+
+// processingRand is drawn by the test apps for the processing delay of every image
+const processingRand = 42
+
+// imageServer serves the fixtures and counts the requests per URI
+type imageServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int
+
+	// gate lets requests of fixtureGated through, one per value
+	gate chan struct{}
+}
+
+func newImageServer(t *testing.T) *imageServer {
+	t.Helper()
+
+	pngData := encodePNG(t, 3, 4)
+	jpegData := encodeJPEG(t, 5, 7)
+	oversized := make([]byte, maxImageSizeMB<<20+1)
+
+	is := &imageServer{hits: make(map[string]int), gate: make(chan struct{}, 64)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(fixturePNG, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngData)
+	})
+	mux.HandleFunc(fixtureJPEG, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	})
+	mux.HandleFunc(fixtureSlow, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(10 * downloadTimeout):
+			w.Write(pngData)
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc(fixtureTruncated, func(w http.ResponseWriter, r *http.Request) {
+		// the server closes the connection when fewer bytes than announced are written
+		w.Header().Set("Content-Length", strconv.Itoa(len(pngData)))
+		w.Write(pngData[:len(pngData)/2])
+	})
+	mux.HandleFunc(fixtureOversized, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(oversized)))
+		w.Write(oversized)
+	})
+	mux.HandleFunc(fixtureStreamed, func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the end makes the response chunked, without a Content-Length
+		for chunk := range slices.Chunk(oversized, 64<<10) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc(fixtureCorrupt, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("this is not an image"))
+	})
+
+	mux.HandleFunc(fixtureGated, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-is.gate:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngData)
+		case <-r.Context().Done():
+		}
+	})
+
+	mux.HandleFunc(fixtureRedirect, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		hops, _ := strconv.Atoi(query.Get("hops"))
+
+		target := query.Get("to")
+		if target == "" {
+			target = fixturePNG
+		}
+		if hops > 1 {
+			query.Set("hops", strconv.Itoa(hops-1))
+			target = fixtureRedirect + "?" + query.Encode()
+		}
+
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+
+	is.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.mu.Lock()
+		is.hits[r.URL.RequestURI()]++
+		is.mu.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(is.Close)
+
+	return is
+}
+
+// open lets n requests of fixtureGated through
+func (is *imageServer) open(n int) {
+	for range n {
+		is.gate <- struct{}{}
+	}
+}
+
+// url returns the URL of a fixture, query tells apart URLs of the same fixture
+// within a job, where duplicates are rejected
+func (is *imageServer) url(fixture, query string) string {
+	if query != "" {
+		fixture += "?" + query
+	}
+	return is.URL + fixture
+}
+
+// hitCount returns the number of requests made for the URI of a fixture
+func (is *imageServer) hitCount(fixture, query string) int {
+	if query != "" {
+		fixture += "?" + query
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.hits[fixture]
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(width, height), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 40), G: uint8(y * 30), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// fakeClock never waits: After fires right away and moves the time forward
+// by the duration, which is recorded
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Waits returns the durations waited for so far
+func (c *fakeClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+// fixedRand always draws the same number
+type fixedRand int
+
+func (r fixedRand) IntN(n int) int {
+	return int(r) % n
+}
+
+// testApp is an App serving its API on a local port, backed by the in-memory
+// repositories and a CSV store master with the stores S1 and S2
+type testApp struct {
+	t *testing.T
+
+	URL        string
+	Jobs       service.JobRepository
+	Clock      *fakeClock
+	StorageDir string
+}
+
+// startApp starts an App on jobs, which may hold jobs left ongoing by a
+// previous run, in memory when nil. configure, if not nil, changes the
+// configuration first.
+func startApp(t *testing.T, jobs service.JobRepository, configure func(cfg *config.Config)) *testApp {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	csvPath := filepath.Join(dir, "stores.csv")
+	csv := "StoreID,StoreName,AreaCode\nS1,First Store,A1\nS2,Second Store,A2\n"
+	if err := os.WriteFile(csvPath, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Storage.Dir = filepath.Join(dir, "files")
+	cfg.Storage.MaxImageSizeMB = maxImageSizeMB
+	cfg.Stores.Source = "csv"
+	cfg.Stores.CSVPath = csvPath
+	cfg.Stores.ReloadInterval = 0
+	cfg.Jobs.Workers = 2
+	cfg.Jobs.QueueSize = 10
+	cfg.Timeouts.Download = downloadTimeout
+	// the image server listens on the loopback interface
+	cfg.Fetch.AllowPrivateNetworks = true
+	if configure != nil {
+		configure(cfg)
+	}
+
+	if jobs == nil {
+		jobs = service.NewMemoryJobRepository()
+	}
+
+	settings := logger.DefaultSettings()
+	settings.Level = logger.LevelError
+	log := logger.New(settings)
+	t.Cleanup(log.Stop)
+
+	clock := &fakeClock{now: time.Date(2024, 11, 16, 10, 0, 0, 0, time.UTC)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a, err := app.New(ctx, cfg, app.Options{
+		Jobs:   jobs,
+		Keys:   service.NewMemoryIdempotencyRepository(),
+		Logger: log,
+		Clock:  clock,
+		Rand:   fixedRand(processingRand),
+	})
+	if err != nil {
+		cancel()
+		t.Fatalf("failed to start app: %v", err)
+	}
+
+	srv := httptest.NewServer(a.Handler())
+
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		if err := a.Shutdown(shutdownCtx); err != nil {
+			t.Errorf("failed to shut down: %v", err)
+		}
+	})
+
+	a.Start(ctx)
+
+	return &testApp{
+		t:          t,
+		URL:        srv.URL,
+		Jobs:       jobs,
+		Clock:      clock,
+		StorageDir: cfg.Storage.Dir,
+	}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON answer into res, if not nil
+func (ta *testApp) do(method, path string, body any, header http.Header, res any) *http.Response {
+	ta.t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			ta.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ta.URL+path, reader)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ta.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+
+	if res != nil {
+		if err := json.Unmarshal(data, res); err != nil {
+			ta.t.Fatalf("%s %s: decoding %q: %v", method, path, data, err)
+		}
+	}
+
+	return resp
+}
+
+// submit posts a job and returns the response and the ID of the job, if created
+func (ta *testApp) submit(body any) (*http.Response, string) {
+	ta.t.Helper()
+
+	var res struct {
+		JobID string `json:"job_id"`
+	}
+	resp := ta.do(http.MethodPost, "/api/submit", body, nil, &res)
+	return resp, res.JobID
+}
+
+// eventStream reads the Server-Sent Events of a job
+type eventStream struct {
+	t      *testing.T
+	events chan events.Event
+}
+
+// stream connects to the event stream of a job, the connection is closed when
+// the test ends
+func (ta *testApp) stream(id string) *eventStream {
+	ta.t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ta.t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ta.URL+"/api/jobs/"+id+"/events/stream", nil)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		ta.t.Fatalf("event stream of job %s: %d", id, resp.StatusCode)
+	}
+
+	es := &eventStream{t: ta.t, events: make(chan events.Event, 64)}
+
+	go func() {
+		defer resp.Body.Close()
+		defer close(es.events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+
+			var ev events.Event
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				ta.t.Errorf("decoding event %q: %v", data, err)
+				return
+			}
+			es.events <- ev
+		}
+	}()
+
+	return es
+}
+
+// next returns the next event of the stream
+func (es *eventStream) next() events.Event {
+	es.t.Helper()
+
+	select {
+	case ev, ok := <-es.events:
+		if !ok {
+			es.t.Fatal("event stream closed")
+		}
+		return ev
+	case <-time.After(10 * time.Second):
+		es.t.Fatal("no event received")
+	}
+	return events.Event{}
+}
+
+// rest returns the events left until the stream is closed
+func (es *eventStream) rest() []events.Event {
+	es.t.Helper()
+
+	var rest []events.Event
+	for {
+		select {
+		case ev, ok := <-es.events:
+			if !ok {
+				return rest
+			}
+			rest = append(rest, ev)
+		case <-time.After(10 * time.Second):
+			es.t.Fatal("event stream not closed")
+		}
+	}
+}
+
+// bootstrapKey is the admin key of the test apps enabling authentication
+const bootstrapKey = "bootstrap-admin-key-of-at-least-32-chars"
+
+// createAPIKey creates a key with the admin key in header and returns the header
+// authenticating with the new key, and its ID
+func (ta *testApp) createAPIKey(admin http.Header, body map[string]any) (http.Header, string) {
+	ta.t.Helper()
+
+	var res struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	resp := ta.do(http.MethodPost, "/api/admin/keys", body, admin, &res)
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(res.Key, "ijp_") {
+		ta.t.Fatalf("create key: got status %d and key %q", resp.StatusCode, res.Key)
+	}
+
+	return http.Header{"Authorization": []string{"Bearer " + res.Key}}, res.ID
+}
+
+// jobStatus is the answer of /api/status
+type jobStatus struct {
+	Status string `json:"status"`
+	JobID  string `json:"job_id"`
+	Error  *struct {
+		StoreID string `json:"store_id"`
+		Error   string `json:"error"`
+	} `json:"error"`
+}
+
+// waitForJob polls the status of a job until it is no longer ongoing
+func (ta *testApp) waitForJob(id string) jobStatus {
+	ta.t.Helper()
+	return ta.waitForJobAs(id, nil)
+}
+
+// waitForJobAs is waitForJob sending header, e.g. with an API key
+func (ta *testApp) waitForJobAs(id string, header http.Header) jobStatus {
+	ta.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var status jobStatus
+		resp := ta.do(http.MethodGet, "/api/status?jobid="+id, nil, header, &status)
+		if resp.StatusCode != http.StatusOK {
+			ta.t.Fatalf("status of job %s: %d", id, resp.StatusCode)
+		}
+
+		if status.Status != "ongoing" {
+			return status
+		}
+		if time.Now().After(deadline) {
+			ta.t.Fatalf("job %s still ongoing", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// jobResult is the answer of /api/jobs/{id}
+type jobResult struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	Count  int    `json:"count"`
+	Visits []struct {
+		StoreID   string    `json:"store_id"`
+		StoreName string    `json:"store_name"`
+		AreaCode  string    `json:"area_code"`
+		VisitTime time.Time `json:"visit_time"`
+		Images    []struct {
+			URL       string `json:"url"`
+			ImageID   string `json:"image_id"`
+			Perimeter int64  `json:"perimeter"`
+		} `json:"images"`
+	} `json:"visits"`
+}
+
+// visit builds a visit of a submission
+func visit(storeID string, imageURLs ...string) map[string]any {
+	return map[string]any{
+		"store_id":   storeID,
+		"visit_time": "2024-11-16T10:30:00Z",
+		"image_url":  imageURLs,
+	}
+}
+
+// job builds a submission of visits
+func job(visits ...map[string]any) map[string]any {
+	return map[string]any{
+		"count":  len(visits),
+		"visits": visits,
+	}
+}
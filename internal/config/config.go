@@ -0,0 +1,545 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/tracing"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the application.
+//
+// Settings are resolved in this order, later sources overriding earlier ones:
+//  1. defaults (see Default)
+//  2. the config file given by -config or IJP_CONFIG (YAML or TOML, by extension)
+//  3. environment variables (IJP_*, plus the legacy MONGODB_URI and WEBHOOK_SECRET)
+//  4. command line flags
+type Config struct {
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	Mongo    MongoConfig    `yaml:"mongo" toml:"mongo"`
+	Storage  StorageConfig  `yaml:"storage" toml:"storage"`
+	Jobs     JobsConfig     `yaml:"jobs" toml:"jobs"`
+	Timeouts TimeoutsConfig `yaml:"timeouts" toml:"timeouts"`
+	Logging  LoggingConfig  `yaml:"logging" toml:"logging"`
+	Stores   StoresConfig   `yaml:"stores" toml:"stores"`
+	Webhook  WebhookConfig  `yaml:"webhook" toml:"webhook"`
+	Tracing  TracingConfig  `yaml:"tracing" toml:"tracing"`
+	Auth     AuthConfig     `yaml:"auth" toml:"auth"`
+	Limits   LimitsConfig   `yaml:"limits" toml:"limits"`
+	Fetch    FetchConfig    `yaml:"fetch" toml:"fetch"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port" toml:"port"`
+}
+
+type MongoConfig struct {
+	URI                   string `yaml:"uri" toml:"uri"`
+	Database              string `yaml:"database" toml:"database"`
+	JobsCollection        string `yaml:"jobs_collection" toml:"jobs_collection"`
+	StoresCollection      string `yaml:"stores_collection" toml:"stores_collection"`
+	IdempotencyCollection string `yaml:"idempotency_collection" toml:"idempotency_collection"`
+	APIKeysCollection     string `yaml:"api_keys_collection" toml:"api_keys_collection"`
+	// MigrationsCollection records the data migrations already applied at startup
+	MigrationsCollection string `yaml:"migrations_collection" toml:"migrations_collection"`
+	// ConnectAttempts is the number of times MongoDB is tried at startup
+	ConnectAttempts int `yaml:"connect_attempts" toml:"connect_attempts"`
+	// ConnectBackoff is the wait after the first failed attempt, doubled after every attempt up to 30s
+	ConnectBackoff time.Duration `yaml:"connect_backoff" toml:"connect_backoff"`
+}
+
+type StorageConfig struct {
+	// Dir is where downloaded images are saved
+	Dir string `yaml:"dir" toml:"dir"`
+	// MaxImageSizeMB fails the download of larger images, 0 disables the limit
+	MaxImageSizeMB int `yaml:"max_image_size_mb" toml:"max_image_size_mb"`
+}
+
+type JobsConfig struct {
+	// Workers is the number of jobs processed concurrently
+	Workers int `yaml:"workers" toml:"workers"`
+	// QueueSize is the number of accepted jobs that can wait for a worker
+	QueueSize int `yaml:"queue_size" toml:"queue_size"`
+	// Resume restarts the jobs left ongoing by the previous run
+	Resume bool `yaml:"resume" toml:"resume"`
+	// DBRetryAttempts is the number of times a job's database write failing with a transient error is tried
+	DBRetryAttempts int `yaml:"db_retry_attempts" toml:"db_retry_attempts"`
+	// DBRetryBackoff is the wait before the first retry, doubled after every attempt
+	DBRetryBackoff time.Duration `yaml:"db_retry_backoff" toml:"db_retry_backoff"`
+	// LeaseTTL is how long a replica holds the jobs it processes without
+	// renewing its lease, the jobs of a replica that died are resumed after it
+	LeaseTTL time.Duration `yaml:"lease_ttl" toml:"lease_ttl"`
+}
+
+type TimeoutsConfig struct {
+	// MongoConnect bounds every connection attempt at startup
+	MongoConnect time.Duration `yaml:"mongo_connect" toml:"mongo_connect"`
+	// MongoOperation bounds every MongoDB call
+	MongoOperation time.Duration `yaml:"mongo_operation" toml:"mongo_operation"`
+	Download       time.Duration `yaml:"download" toml:"download"`
+	Webhook        time.Duration `yaml:"webhook" toml:"webhook"`
+	ReadHeader     time.Duration `yaml:"read_header" toml:"read_header"`
+	// Shutdown bounds the graceful shutdown, running jobs are checkpointed when it passes
+	Shutdown time.Duration `yaml:"shutdown" toml:"shutdown"`
+}
+
+type LoggingConfig struct {
+	// Sink is stdout, file (app.log in Dir) or both
+	Sink string `yaml:"sink" toml:"sink"`
+	Dir  string `yaml:"dir" toml:"dir"`
+	// MaxSizeMB rotates the log file before it grows past this size, 0 disables it
+	MaxSizeMB int `yaml:"max_size_mb" toml:"max_size_mb"`
+	// RotateInterval rotates the log file at the end of every interval, 0 disables it
+	RotateInterval time.Duration `yaml:"rotate_interval" toml:"rotate_interval"`
+	// MaxBackups is the number of rotated files kept, 0 keeps all of them
+	MaxBackups int `yaml:"max_backups" toml:"max_backups"`
+	// MaxAge removes rotated files older than this, 0 keeps them
+	MaxAge time.Duration `yaml:"max_age" toml:"max_age"`
+	// Level is debug, info, warn or error
+	Level string `yaml:"level" toml:"level"`
+	// Format is text or json
+	Format string `yaml:"format" toml:"format"`
+	// Overflow is drop or spill, what to do with a message when the buffer is full
+	Overflow   string `yaml:"overflow" toml:"overflow"`
+	BufferSize int    `yaml:"buffer_size" toml:"buffer_size"`
+}
+
+type StoresConfig struct {
+	Source         string        `yaml:"source" toml:"source"`
+	CSVPath        string        `yaml:"csv_path" toml:"csv_path"`
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+	LazyCheck      bool          `yaml:"lazy_check" toml:"lazy_check"`
+}
+
+type WebhookConfig struct {
+	Secret         string        `yaml:"secret" toml:"secret"`
+	MaxAttempts    int           `yaml:"max_attempts" toml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" toml:"initial_backoff"`
+}
+
+type TracingConfig struct {
+	Exporter     string  `yaml:"exporter" toml:"exporter"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+	OTLPInsecure bool    `yaml:"otlp_insecure" toml:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+type AuthConfig struct {
+	// Enabled requires an API key on every request but the probes and the metrics
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// BootstrapKey is stored as an admin key at startup, to create the first keys with
+	BootstrapKey string `yaml:"bootstrap_key" toml:"bootstrap_key"`
+}
+
+// LimitsConfig bounds the submissions made with every API key that has no
+// limits of its own, 0 leaves a limit off. Admin keys are not limited.
+type LimitsConfig struct {
+	RequestsPerMinute int `yaml:"requests_per_minute" toml:"requests_per_minute"`
+	ActiveJobs        int `yaml:"active_jobs" toml:"active_jobs"`
+	ImagesPerJob      int `yaml:"images_per_job" toml:"images_per_job"`
+	ImagesPerDay      int `yaml:"images_per_day" toml:"images_per_day"`
+}
+
+// FetchConfig restricts the image and callback URLs, checked when a job is
+// submitted and again when connecting, after resolving the host and following
+// redirects
+type FetchConfig struct {
+	// AllowedSchemes are the schemes of the image and callback URLs, among http and https
+	AllowedSchemes []string `yaml:"allowed_schemes" toml:"allowed_schemes"`
+	// AllowPrivateNetworks allows loopback and private addresses. Link-local
+	// addresses, such as the cloud metadata services, are always blocked.
+	AllowPrivateNetworks bool `yaml:"allow_private_networks" toml:"allow_private_networks"`
+	// AllowedHosts, when not empty, are the only hosts images are downloaded
+	// from. *.example.com matches every subdomain of example.com.
+	AllowedHosts []string `yaml:"allowed_hosts" toml:"allowed_hosts"`
+	// DeniedHosts are never downloaded from, even when allowed
+	DeniedHosts []string `yaml:"denied_hosts" toml:"denied_hosts"`
+	// MaxRedirects is the number of redirects followed by a download, 0 follows none
+	MaxRedirects int `yaml:"max_redirects" toml:"max_redirects"`
+}
+
+// minLeaseTTL leaves time to renew the leases of the jobs, a third of it apart
+const minLeaseTTL = 100 * time.Millisecond
+
+// minBootstrapKeyLen keeps the bootstrap key as hard to guess as a generated one
+const minBootstrapKeyLen = 32
+
+// Default returns the configuration used when nothing else is given
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: 8080,
+		},
+		Mongo: MongoConfig{
+			Database:              "image-job-processor",
+			JobsCollection:        "stores_visits",
+			StoresCollection:      "stores",
+			IdempotencyCollection: "idempotency_keys",
+			APIKeysCollection:     "api_keys",
+			MigrationsCollection:  "migrations",
+			ConnectAttempts:       10,
+			ConnectBackoff:        1 * time.Second,
+		},
+		Storage: StorageConfig{
+			Dir:            "./files",
+			MaxImageSizeMB: 20,
+		},
+		Jobs: JobsConfig{
+			Workers:   8,
+			QueueSize: 1000,
+			Resume:    true,
+
+			DBRetryAttempts: 5,
+			DBRetryBackoff:  500 * time.Millisecond,
+			LeaseTTL:        1 * time.Minute,
+		},
+		Timeouts: TimeoutsConfig{
+			MongoConnect:   10 * time.Second,
+			MongoOperation: 10 * time.Second,
+			Download:       30 * time.Second,
+			Webhook:        10 * time.Second,
+			ReadHeader:     10 * time.Second,
+			Shutdown:       30 * time.Second,
+		},
+		Logging: LoggingConfig{
+			Sink:       "stdout",
+			Dir:        "logs",
+			MaxSizeMB:  100,
+			MaxBackups: 10,
+			Level:      "info",
+			Format:     "text",
+			Overflow:   "drop",
+			BufferSize: 1000,
+		},
+		Stores: StoresConfig{
+			Source:         "mongo",
+			CSVPath:        "StoreMasterAssignment.csv",
+			ReloadInterval: 30 * time.Second,
+		},
+		Webhook: WebhookConfig{
+			MaxAttempts:    5,
+			InitialBackoff: 1 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+		Limits: LimitsConfig{
+			RequestsPerMinute: 60,
+			ActiveJobs:        10,
+			ImagesPerJob:      1000,
+			ImagesPerDay:      100000,
+		},
+		Fetch: FetchConfig{
+			AllowedSchemes: []string{"http", "https"},
+			MaxRedirects:   5,
+		},
+	}
+}
+
+// binding ties a setting to its environment variable and command line flags
+type binding struct {
+	env   string
+	flags []string
+	usage string
+	value flag.Value
+}
+
+// bindings lists every setting that can be set from the environment or the command line.
+// The first flag is the canonical one, the others are kept for compatibility.
+func (c *Config) bindings() []binding {
+	return []binding{
+		{env: "IJP_SERVER_PORT", flags: []string{"server.port", "p"}, usage: "Port number to start server on", value: (*intValue)(&c.Server.Port)},
+
+		{env: "IJP_MONGO_URI", flags: []string{"mongo.uri"}, usage: "MongoDB connection URI", value: (*stringValue)(&c.Mongo.URI)},
+		{env: "IJP_MONGO_DATABASE", flags: []string{"mongo.database"}, usage: "MongoDB database name", value: (*stringValue)(&c.Mongo.Database)},
+		{env: "IJP_MONGO_JOBS_COLLECTION", flags: []string{"mongo.jobs-collection"}, usage: "Collection holding the jobs", value: (*stringValue)(&c.Mongo.JobsCollection)},
+		{env: "IJP_MONGO_STORES_COLLECTION", flags: []string{"mongo.stores-collection"}, usage: "Collection holding the store master", value: (*stringValue)(&c.Mongo.StoresCollection)},
+		{env: "IJP_MONGO_IDEMPOTENCY_COLLECTION", flags: []string{"mongo.idempotency-collection"}, usage: "Collection holding the idempotency keys", value: (*stringValue)(&c.Mongo.IdempotencyCollection)},
+		{env: "IJP_MONGO_API_KEYS_COLLECTION", flags: []string{"mongo.api-keys-collection"}, usage: "Collection holding the hashed API keys", value: (*stringValue)(&c.Mongo.APIKeysCollection)},
+		{env: "IJP_MONGO_MIGRATIONS_COLLECTION", flags: []string{"mongo.migrations-collection"}, usage: "Collection recording the data migrations already applied", value: (*stringValue)(&c.Mongo.MigrationsCollection)},
+		{env: "IJP_MONGO_CONNECT_ATTEMPTS", flags: []string{"mongo.connect-attempts"}, usage: "Number of times MongoDB is tried at startup before giving up", value: (*intValue)(&c.Mongo.ConnectAttempts)},
+		{env: "IJP_MONGO_CONNECT_BACKOFF", flags: []string{"mongo.connect-backoff"}, usage: "Wait after the first failed connection attempt, doubled after every attempt up to 30s", value: (*durationValue)(&c.Mongo.ConnectBackoff)},
+
+		{env: "IJP_STORAGE_DIR", flags: []string{"storage.dir"}, usage: "Directory where downloaded images are saved", value: (*stringValue)(&c.Storage.Dir)},
+		{env: "IJP_STORAGE_MAX_IMAGE_SIZE_MB", flags: []string{"storage.max-image-size-mb"}, usage: "Fail the download of images larger than this many megabytes, 0 disables the limit", value: (*intValue)(&c.Storage.MaxImageSizeMB)},
+
+		{env: "IJP_JOBS_WORKERS", flags: []string{"jobs.workers"}, usage: "Number of jobs processed concurrently", value: (*intValue)(&c.Jobs.Workers)},
+		{env: "IJP_JOBS_QUEUE_SIZE", flags: []string{"jobs.queue-size"}, usage: "Number of accepted jobs that can wait for a worker", value: (*intValue)(&c.Jobs.QueueSize)},
+		{env: "IJP_JOBS_RESUME", flags: []string{"jobs.resume"}, usage: "Resume the jobs left ongoing by the previous run", value: (*boolValue)(&c.Jobs.Resume)},
+		{env: "IJP_JOBS_DB_RETRY_ATTEMPTS", flags: []string{"jobs.db-retry-attempts"}, usage: "Number of times a job's database write failing with a transient error is tried", value: (*intValue)(&c.Jobs.DBRetryAttempts)},
+		{env: "IJP_JOBS_DB_RETRY_BACKOFF", flags: []string{"jobs.db-retry-backoff"}, usage: "Wait before retrying a job's database write, doubled after every attempt", value: (*durationValue)(&c.Jobs.DBRetryBackoff)},
+		{env: "IJP_JOBS_LEASE_TTL", flags: []string{"jobs.lease-ttl"}, usage: "How long a replica holds its jobs without renewing its lease, the jobs of a replica that died are resumed after it", value: (*durationValue)(&c.Jobs.LeaseTTL)},
+
+		{env: "IJP_TIMEOUTS_MONGO_CONNECT", flags: []string{"timeouts.mongo-connect"}, usage: "Timeout of every attempt to connect to MongoDB at startup", value: (*durationValue)(&c.Timeouts.MongoConnect)},
+		{env: "IJP_TIMEOUTS_MONGO_OPERATION", flags: []string{"timeouts.mongo-operation"}, usage: "Timeout of every MongoDB call", value: (*durationValue)(&c.Timeouts.MongoOperation)},
+		{env: "IJP_TIMEOUTS_DOWNLOAD", flags: []string{"timeouts.download"}, usage: "Timeout to download a single image", value: (*durationValue)(&c.Timeouts.Download)},
+		{env: "IJP_TIMEOUTS_WEBHOOK", flags: []string{"timeouts.webhook"}, usage: "Timeout of a single webhook delivery", value: (*durationValue)(&c.Timeouts.Webhook)},
+		{env: "IJP_TIMEOUTS_READ_HEADER", flags: []string{"timeouts.read-header"}, usage: "Timeout to read the headers of an HTTP request", value: (*durationValue)(&c.Timeouts.ReadHeader)},
+		{env: "IJP_TIMEOUTS_SHUTDOWN", flags: []string{"timeouts.shutdown"}, usage: "Time given to running jobs to finish on shutdown before they are checkpointed", value: (*durationValue)(&c.Timeouts.Shutdown)},
+
+		{env: "IJP_LOGGING_SINK", flags: []string{"logging.sink"}, usage: "Where logs are written: stdout, file (app.log in the logging directory) or both", value: (*stringValue)(&c.Logging.Sink)},
+		{env: "IJP_LOGGING_DIR", flags: []string{"logging.dir"}, usage: "Directory of the log file", value: (*stringValue)(&c.Logging.Dir)},
+		{env: "IJP_LOGGING_MAX_SIZE_MB", flags: []string{"logging.max-size-mb"}, usage: "Rotate the log file before it grows past this many megabytes, 0 disables it", value: (*intValue)(&c.Logging.MaxSizeMB)},
+		{env: "IJP_LOGGING_ROTATE_INTERVAL", flags: []string{"logging.rotate-interval"}, usage: "Rotate the log file at the end of every interval, aligned to UTC, 0 disables it", value: (*durationValue)(&c.Logging.RotateInterval)},
+		{env: "IJP_LOGGING_MAX_BACKUPS", flags: []string{"logging.max-backups"}, usage: "Number of rotated log files kept, 0 keeps all of them", value: (*intValue)(&c.Logging.MaxBackups)},
+		{env: "IJP_LOGGING_MAX_AGE", flags: []string{"logging.max-age"}, usage: "Remove rotated log files older than this, 0 keeps them", value: (*durationValue)(&c.Logging.MaxAge)},
+		{env: "IJP_LOGGING_LEVEL", flags: []string{"logging.level"}, usage: "Lowest level logged: debug, info, warn or error", value: (*stringValue)(&c.Logging.Level)},
+		{env: "IJP_LOGGING_FORMAT", flags: []string{"logging.format"}, usage: "Log format: text or json", value: (*stringValue)(&c.Logging.Format)},
+		{env: "IJP_LOGGING_OVERFLOW", flags: []string{"logging.overflow"}, usage: "What to do with a message when the log buffer is full: drop or spill (write from the caller)", value: (*stringValue)(&c.Logging.Overflow)},
+		{env: "IJP_LOGGING_BUFFER_SIZE", flags: []string{"logging.buffer-size"}, usage: "Number of log messages waiting to be written", value: (*intValue)(&c.Logging.BufferSize)},
+
+		{env: "IJP_STORES_SOURCE", flags: []string{"stores.source", "store-source"}, usage: "Where to load the store master from: mongo (seeded once from the CSV file) or csv", value: (*stringValue)(&c.Stores.Source)},
+		{env: "IJP_STORES_CSV_PATH", flags: []string{"stores.csv-path", "f"}, usage: "Store master CSV file, empty to skip seeding with the mongo source", value: (*stringValue)(&c.Stores.CSVPath)},
+		{env: "IJP_STORES_RELOAD_INTERVAL", flags: []string{"stores.reload-interval", "store-reload-interval"}, usage: "How often to refresh the store master, 0 disables reloading", value: (*durationValue)(&c.Stores.ReloadInterval)},
+		{env: "IJP_STORES_LAZY_CHECK", flags: []string{"stores.lazy-check", "lazy-store-check"}, usage: "Check store IDs while processing the job instead of at submit time", value: (*boolValue)(&c.Stores.LazyCheck)},
+
+		{env: "IJP_WEBHOOK_SECRET", flags: []string{"webhook.secret"}, usage: "Secret used to sign webhook callbacks", value: (*stringValue)(&c.Webhook.Secret)},
+		{env: "IJP_WEBHOOK_MAX_ATTEMPTS", flags: []string{"webhook.max-attempts"}, usage: "Number of delivery attempts of a webhook callback", value: (*intValue)(&c.Webhook.MaxAttempts)},
+		{env: "IJP_WEBHOOK_INITIAL_BACKOFF", flags: []string{"webhook.initial-backoff"}, usage: "Wait before the first webhook retry, doubled after every attempt", value: (*durationValue)(&c.Webhook.InitialBackoff)},
+
+		{env: "IJP_TRACING_EXPORTER", flags: []string{"tracing.exporter"}, usage: "Where spans are sent: none, stdout or otlp (OTLP over HTTP)", value: (*stringValue)(&c.Tracing.Exporter)},
+		{env: "IJP_TRACING_OTLP_ENDPOINT", flags: []string{"tracing.otlp-endpoint"}, usage: "host:port of the OTLP collector, empty uses OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318", value: (*stringValue)(&c.Tracing.OTLPEndpoint)},
+		{env: "IJP_TRACING_OTLP_INSECURE", flags: []string{"tracing.otlp-insecure"}, usage: "Send spans to the OTLP collector over plain HTTP", value: (*boolValue)(&c.Tracing.OTLPInsecure)},
+		{env: "IJP_TRACING_SAMPLE_RATIO", flags: []string{"tracing.sample-ratio"}, usage: "Fraction of new traces recorded, between 0 and 1", value: (*floatValue)(&c.Tracing.SampleRatio)},
+
+		{env: "IJP_AUTH_ENABLED", flags: []string{"auth.enabled"}, usage: "Require an API key on every request but the probes and the metrics", value: (*boolValue)(&c.Auth.Enabled)},
+		{env: "IJP_AUTH_BOOTSTRAP_KEY", flags: []string{"auth.bootstrap-key"}, usage: "Admin API key stored at startup, to create the first keys with", value: (*stringValue)(&c.Auth.BootstrapKey)},
+
+		{env: "IJP_LIMITS_REQUESTS_PER_MINUTE", flags: []string{"limits.requests-per-minute"}, usage: "Submit requests per minute of an API key, 0 disables the limit", value: (*intValue)(&c.Limits.RequestsPerMinute)},
+		{env: "IJP_LIMITS_ACTIVE_JOBS", flags: []string{"limits.active-jobs"}, usage: "Ongoing jobs of an API key, 0 disables the limit", value: (*intValue)(&c.Limits.ActiveJobs)},
+		{env: "IJP_LIMITS_IMAGES_PER_JOB", flags: []string{"limits.images-per-job"}, usage: "Images in a job submitted with an API key, 0 disables the limit", value: (*intValue)(&c.Limits.ImagesPerJob)},
+		{env: "IJP_LIMITS_IMAGES_PER_DAY", flags: []string{"limits.images-per-day"}, usage: "Images submitted with an API key since midnight UTC, 0 disables the limit", value: (*intValue)(&c.Limits.ImagesPerDay)},
+
+		{env: "IJP_FETCH_ALLOWED_SCHEMES", flags: []string{"fetch.allowed-schemes"}, usage: "Comma separated schemes of the image URLs, among http and https", value: (*stringListValue)(&c.Fetch.AllowedSchemes)},
+		{env: "IJP_FETCH_ALLOW_PRIVATE_NETWORKS", flags: []string{"fetch.allow-private-networks"}, usage: "Download images from loopback and private addresses, link-local ones stay blocked", value: (*boolValue)(&c.Fetch.AllowPrivateNetworks)},
+		{env: "IJP_FETCH_ALLOWED_HOSTS", flags: []string{"fetch.allowed-hosts"}, usage: "Comma separated hosts images may only be downloaded from, *.example.com matches the subdomains, empty allows every host", value: (*stringListValue)(&c.Fetch.AllowedHosts)},
+		{env: "IJP_FETCH_DENIED_HOSTS", flags: []string{"fetch.denied-hosts"}, usage: "Comma separated hosts images are never downloaded from, *.example.com matches the subdomains", value: (*stringListValue)(&c.Fetch.DeniedHosts)},
+		{env: "IJP_FETCH_MAX_REDIRECTS", flags: []string{"fetch.max-redirects"}, usage: "Redirects followed by an image download, 0 follows none", value: (*intValue)(&c.Fetch.MaxRedirects)},
+	}
+}
+
+// legacyEnv maps environment variables used by earlier versions to the current ones.
+// The current names win when both are set.
+var legacyEnv = map[string]string{
+	"MONGODB_URI":    "IJP_MONGO_URI",
+	"WEBHOOK_SECRET": "IJP_WEBHOOK_SECRET",
+}
+
+// Load resolves the configuration from the defaults, the config file, the
+// environment and the command line arguments (without the program name)
+func Load(args []string) (*Config, error) {
+	// first pass: find out which flags were given, their values are applied last
+	probe := Default()
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("IJP_CONFIG"), "YAML or TOML config file")
+	for _, b := range probe.bindings() {
+		for _, name := range b.flags {
+			fs.Var(b.value, name, b.usage)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	cfg := Default()
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	bindings := cfg.bindings()
+
+	if err := cfg.loadEnv(bindings); err != nil {
+		return nil, err
+	}
+
+	for _, b := range bindings {
+		for _, name := range b.flags {
+			if raw, ok := given[name]; ok {
+				b.value.Set(raw)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// loadFile decodes a YAML or TOML file, chosen by its extension, on top of cfg
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("unsupported config file %s, use .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// loadEnv applies the environment variables on top of cfg
+func (c *Config) loadEnv(bindings []binding) error {
+	byEnv := make(map[string]binding, len(bindings))
+	for _, b := range bindings {
+		byEnv[b.env] = b
+	}
+
+	for legacy, current := range legacyEnv {
+		if _, ok := os.LookupEnv(current); ok {
+			continue
+		}
+		if value, ok := os.LookupEnv(legacy); ok {
+			if err := byEnv[current].value.Set(value); err != nil {
+				return fmt.Errorf("invalid %s: %w", legacy, err)
+			}
+		}
+	}
+
+	for _, b := range bindings {
+		if value, ok := os.LookupEnv(b.env); ok {
+			if err := b.value.Set(value); err != nil {
+				return fmt.Errorf("invalid %s: %w", b.env, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that every setting has a usable value
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port must be between 1 and 65535"))
+	}
+	if c.Mongo.Database == "" || c.Mongo.JobsCollection == "" || c.Mongo.StoresCollection == "" || c.Mongo.IdempotencyCollection == "" || c.Mongo.APIKeysCollection == "" || c.Mongo.MigrationsCollection == "" {
+		errs = append(errs, fmt.Errorf("mongo database and collection names can not be empty"))
+	}
+	if c.Mongo.ConnectAttempts < 1 {
+		errs = append(errs, fmt.Errorf("mongo.connect_attempts must be at least 1"))
+	}
+	if c.Mongo.ConnectBackoff < 0 {
+		errs = append(errs, fmt.Errorf("mongo.connect_backoff can not be negative"))
+	}
+	if c.Storage.Dir == "" {
+		errs = append(errs, fmt.Errorf("storage.dir can not be empty"))
+	}
+	if c.Storage.MaxImageSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("storage.max_image_size_mb can not be negative"))
+	}
+	if c.Jobs.Workers < 1 {
+		errs = append(errs, fmt.Errorf("jobs.workers must be at least 1"))
+	}
+	if c.Jobs.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("jobs.queue_size can not be negative"))
+	}
+	if c.Jobs.DBRetryAttempts < 1 {
+		errs = append(errs, fmt.Errorf("jobs.db_retry_attempts must be at least 1"))
+	}
+	if c.Jobs.DBRetryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("jobs.db_retry_backoff can not be negative"))
+	}
+	if c.Jobs.LeaseTTL < minLeaseTTL {
+		errs = append(errs, fmt.Errorf("jobs.lease_ttl must be at least %s", minLeaseTTL))
+	}
+	if c.Timeouts.MongoConnect <= 0 || c.Timeouts.MongoOperation <= 0 || c.Timeouts.Download <= 0 || c.Timeouts.Webhook <= 0 || c.Timeouts.ReadHeader <= 0 || c.Timeouts.Shutdown <= 0 {
+		errs = append(errs, fmt.Errorf("timeouts must be greater than zero"))
+	}
+	if c.Logging.Sink != logger.SinkStdout && c.Logging.Sink != logger.SinkFile && c.Logging.Sink != logger.SinkBoth {
+		errs = append(errs, fmt.Errorf("logging.sink must be stdout, file or both"))
+	}
+	if c.Logging.Sink != logger.SinkStdout && c.Logging.Dir == "" {
+		errs = append(errs, fmt.Errorf("logging.dir can not be empty when logging to a file"))
+	}
+	if c.Logging.MaxSizeMB < 0 || c.Logging.RotateInterval < 0 || c.Logging.MaxBackups < 0 || c.Logging.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("logging rotation limits can not be negative"))
+	}
+	if _, err := logger.ParseLevel(c.Logging.Level); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level must be debug, info, warn or error"))
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		errs = append(errs, fmt.Errorf("logging.format must be text or json"))
+	}
+	if c.Logging.Overflow != logger.OverflowDrop && c.Logging.Overflow != logger.OverflowSpill {
+		errs = append(errs, fmt.Errorf("logging.overflow must be drop or spill"))
+	}
+	if c.Logging.BufferSize < 1 {
+		errs = append(errs, fmt.Errorf("logging.buffer_size must be at least 1"))
+	}
+	if c.Stores.Source != "mongo" && c.Stores.Source != "csv" {
+		errs = append(errs, fmt.Errorf("stores.source must be mongo or csv"))
+	}
+	// the jobs need MongoDB as well, which the App checks as it can replace them
+	if c.Stores.Source == "mongo" && c.Mongo.URI == "" {
+		errs = append(errs, fmt.Errorf("mongo.uri is required with the mongo store source, set MONGODB_URI or IJP_MONGO_URI"))
+	}
+	if c.Stores.Source == "csv" && c.Stores.CSVPath == "" {
+		errs = append(errs, fmt.Errorf("stores.csv_path is required with the csv store source"))
+	}
+	if c.Stores.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("stores.reload_interval can not be negative"))
+	}
+	if c.Webhook.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhook.max_attempts must be at least 1"))
+	}
+	if c.Webhook.InitialBackoff < 0 {
+		errs = append(errs, fmt.Errorf("webhook.initial_backoff can not be negative"))
+	}
+	if c.Tracing.Exporter != tracing.ExporterNone && c.Tracing.Exporter != tracing.ExporterStdout && c.Tracing.Exporter != tracing.ExporterOTLP {
+		errs = append(errs, fmt.Errorf("tracing.exporter must be none, stdout or otlp"))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio must be between 0 and 1"))
+	}
+	if c.Limits.RequestsPerMinute < 0 || c.Limits.ActiveJobs < 0 || c.Limits.ImagesPerJob < 0 || c.Limits.ImagesPerDay < 0 {
+		errs = append(errs, fmt.Errorf("limits can not be negative"))
+	}
+	if len(c.Fetch.AllowedSchemes) == 0 {
+		errs = append(errs, fmt.Errorf("fetch.allowed_schemes can not be empty"))
+	}
+	for _, scheme := range c.Fetch.AllowedSchemes {
+		if scheme != "http" && scheme != "https" {
+			errs = append(errs, fmt.Errorf("fetch.allowed_schemes can only hold http and https, got %q", scheme))
+		}
+	}
+	if c.Fetch.MaxRedirects < 0 {
+		errs = append(errs, fmt.Errorf("fetch.max_redirects can not be negative"))
+	}
+	if c.Auth.BootstrapKey != "" && len(c.Auth.BootstrapKey) < minBootstrapKeyLen {
+		errs = append(errs, fmt.Errorf("auth.bootstrap_key must be at least %d characters long", minBootstrapKeyLen))
+	}
+
+	return errors.Join(errs...)
+}
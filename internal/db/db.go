@@ -2,42 +2,106 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"image-job-processor/internal/logger"
-	"log"
-	"os"
-	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	clientInstance *mongo.Client
-	once           sync.Once
-)
+// Settings of the connection to MongoDB
+type Settings struct {
+	URI string
+	// ConnectTimeout bounds every connection attempt
+	ConnectTimeout time.Duration
+	// ConnectAttempts is the number of pings tried before giving up. MongoDB
+	// may still be starting, as it does when both are started by docker compose.
+	ConnectAttempts int
+	// ConnectBackoff is the wait after the first failed attempt, doubled after
+	// every attempt up to maxConnectBackoff
+	ConnectBackoff time.Duration
+}
 
-// GetMongoClient returns a singleton instance of the MongoDB client
-func GetMongoClient() *mongo.Client {
-	once.Do(func() {
-		var err error
-		mongoURI := os.Getenv("MONGODB_URI") // Read the MongoDB URI from the environment variable
-		if mongoURI == "" {
-			log.Fatal("MONGODB_URI environment variable is not set")
-		}
+const maxConnectBackoff = 30 * time.Second
+
+// Connect returns a client of the deployment at settings.URI once it answers.
+// It gives up after settings.ConnectAttempts attempts or when ctx is done.
+// The client must be released with Disconnect.
+func Connect(ctx context.Context, settings Settings) (*mongo.Client, error) {
+	if settings.URI == "" {
+		return nil, errors.New("MongoDB URI is not set")
+	}
+
+	// Connect only validates the options, the client connects in the background
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(settings.URI))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitForServer(ctx, client, settings); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	logger.FromContext(ctx).Info("Successfully established connection to mongodb")
+	return client, nil
+}
+
+// waitForServer pings the deployment until it answers, backing off between attempts
+func waitForServer(ctx context.Context, client *mongo.Client, settings Settings) error {
+	backoff := settings.ConnectBackoff
+
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, settings.ConnectTimeout)
+		err := client.Ping(pingCtx, nil)
+		cancel()
 
-		clientOptions := options.Client().ApplyURI(mongoURI)
-		clientInstance, err = mongo.Connect(context.TODO(), clientOptions)
-		if err != nil {
-			log.Fatal(err)
+		if err == nil {
+			return nil
 		}
+		if attempt >= settings.ConnectAttempts {
+			return fmt.Errorf("mongodb did not answer after %d attempts: %w", attempt, err)
+		}
+
+		logger.FromContext(ctx).Warn("Failed to reach mongodb, retrying", "attempt", attempt, "retry_in", backoff, "error", err)
 
-		// Check the connection
-		err = clientInstance.Ping(context.TODO(), nil)
-		if err != nil {
-			log.Fatal(err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up connecting to mongodb: %w", ctx.Err())
 		}
 
-		logger.GetLogger().Log("Successfully established connection to mongodb")
-	})
-	return clientInstance
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// IsTransient reports whether err is a MongoDB error that may not happen
+// again, such as a network error, a timeout or a primary stepping down, so
+// that the operation is worth retrying
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError")
+	}
+
+	return false
+}
+
+// Disconnect closes the connections of client, waiting at most timeout for
+// the operations in progress
+func Disconnect(client *mongo.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return client.Disconnect(ctx)
 }
@@ -0,0 +1,135 @@
+package events
+
+import (
+	"sync"
+)
+
+// Event types published while a job is processed
+const (
+	TypeProgress  = "progress"
+	TypeCompleted = "completed"
+	TypeFailed    = "failed"
+)
+
+// Event describes a change in the progress of a job
+type Event struct {
+	Type            string `json:"type"`
+	JobID           string `json:"job_id"`
+	StoreID         string `json:"store_id,omitempty"`
+	VisitIndex      int    `json:"visit_index"`
+	VisitsTotal     int    `json:"visits_total"`
+	ImagesProcessed int    `json:"images_processed"`
+	ImagesTotal     int    `json:"images_total"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Terminal reports whether no further events will follow for the job
+func (e Event) Terminal() bool {
+	return e.Type == TypeCompleted || e.Type == TypeFailed
+}
+
+// Broker fans job events out to subscribers. The in-process implementation only
+// sees jobs processed by this replica; a change stream backed implementation can
+// be swapped in when several replicas run.
+type Broker interface {
+	Publish(e Event)
+	Subscribe(jobID string) (<-chan Event, func())
+	// Latest returns the last event published for jobID while the job is
+	// processed, false once it has ended or if no event was published
+	Latest(jobID string) (Event, bool)
+	// Forget drops the last event of jobID once the job is no longer
+	// processed, e.g. when it is checkpointed without ending
+	Forget(jobID string)
+}
+
+const subscriberBuffer = 64
+
+// memoryBroker is a Broker that delivers events within the current process
+type memoryBroker struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan Event]struct{}
+	// last holds the last event of the jobs being processed
+	last map[string]Event
+}
+
+// NewBroker creates a Broker delivering events within the current process
+func NewBroker() Broker {
+	return &memoryBroker{
+		subs: make(map[string]map[chan Event]struct{}),
+		last: make(map[string]Event),
+	}
+}
+
+// Publish sends e to every subscriber of its job. Slow subscribers miss
+// progress events instead of blocking the job.
+func (b *memoryBroker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.Terminal() {
+		delete(b.last, e.JobID)
+	} else {
+		b.last[e.JobID] = e
+	}
+
+	for ch := range b.subs[e.JobID] {
+		select {
+		case ch <- e:
+		default:
+			if e.Terminal() {
+				// make room so the terminal event is never lost
+				select {
+				case <-ch:
+				default:
+				}
+				select {
+				case ch <- e:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Subscribe registers for events of jobID. The returned func must be called to unsubscribe.
+func (b *memoryBroker) Subscribe(jobID string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subs[jobID] == nil {
+		b.subs[jobID] = make(map[chan Event]struct{})
+	}
+	b.subs[jobID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var unsubscribeOnce sync.Once
+	unsubscribe := func() {
+		unsubscribeOnce.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[jobID], ch)
+			if len(b.subs[jobID]) == 0 {
+				delete(b.subs, jobID)
+			}
+			b.mu.Unlock()
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// Latest returns the last event published for jobID while the job is processed
+func (b *memoryBroker) Latest(jobID string) (Event, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.last[jobID]
+	return e, ok
+}
+
+// Forget drops the last event of jobID
+func (b *memoryBroker) Forget(jobID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.last, jobID)
+}
@@ -2,19 +2,60 @@ package files
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image-job-processor/internal/logger"
+	"image-job-processor/internal/metrics"
+	"image-job-processor/internal/tracing"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Fetcher downloads images over HTTP
+type Fetcher struct {
+	client *http.Client
+	// timeout bounds the download of a single image
+	timeout time.Duration
+	// maxBytes fails the download of larger images, 0 disables the limit
+	maxBytes int64
+}
+
+// NewFetcher creates a Fetcher sending its requests with client, or
+// http.DefaultClient if it is nil. Every download is bounded by timeout and
+// fails if the image is larger than maxBytes, unless it is 0.
+func NewFetcher(client *http.Client, timeout time.Duration, maxBytes int64) *Fetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Fetcher{client: client, timeout: timeout, maxBytes: maxBytes}
+}
+
+// Storage saves images under a directory
+type Storage struct {
+	dir string
+}
+
+// NewStorage creates a Storage saving images under dir
+func NewStorage(dir string) *Storage {
+	return &Storage{dir: dir}
+}
+
+// Dir returns the directory images are saved under
+func (st *Storage) Dir() string {
+	return st.dir
+}
+
 // ImageHolder is a struct that holds an image and its metadata.
 type ImageHolder struct {
 	ID     string
@@ -25,39 +66,49 @@ type ImageHolder struct {
 }
 
 // DownloadImage downloads an image from the specified URL and returns an ImageHolder.
-func DownloadImage(url string) (*ImageHolder, error) {
-	// Send a GET request to the URL
-	resp, err := http.Get(url)
+func (f *Fetcher) DownloadImage(ctx context.Context, url string) (ih *ImageHolder, err error) {
+	ctx, span := tracing.Start(ctx, "DownloadImage", trace.WithAttributes(semconv.URLFull(url)))
+
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		metrics.ImageDownloadDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
+	imageData, err := f.fetch(ctx, url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download image: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Check if the response status is OK
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download image: received status code %d", resp.StatusCode)
-	}
-
-	// Read the response body
-	imageData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read image data: %w", err)
+		return nil, err
 	}
+	metrics.ImageDownloadBytes.Observe(float64(len(imageData)))
 
 	// Decode the image
+	_, decodeSpan := tracing.Start(ctx, "DecodeImage")
 	img, format, err := image.Decode(bytes.NewReader(imageData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+		err = fmt.Errorf("failed to decode image: %w", err)
+		tracing.End(decodeSpan, err)
+		return nil, err
 	}
 
 	// Get image dimensions
 	bounds := img.Bounds()
 	width, height := bounds.Max.X, bounds.Max.Y
 
+	decodeSpan.SetAttributes(
+		attribute.String("image.format", format),
+		attribute.Int("image.width", width),
+		attribute.Int("image.height", height),
+	)
+	decodeSpan.End()
+
 	// Generate a new UUID and convert it to a string
 	id := uuid.New().String()
 
-	logger.GetLogger().Log(fmt.Sprintf("Downloaded image from %v", url))
+	logger.FromContext(ctx).Debug("Downloaded image", "url", url, "bytes", len(imageData))
 
 	return &ImageHolder{
 		ID:     id,
@@ -68,14 +119,92 @@ func DownloadImage(url string) (*ImageHolder, error) {
 	}, nil
 }
 
-// SaveImage saves the image to a file in the specified format (PNG or JPEG).
-func (ih *ImageHolder) SaveImage(documentID, storeID string) error {
+// fetch reads the body of url, bounded by the timeout of f
+func (f *Fetcher) fetch(ctx context.Context, url string) (data []byte, err error) {
+	ctx, span := tracing.Start(ctx, "FetchImage",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodGet, semconv.URLFull(url)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+
+	// Send a GET request to the URL
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+
+	// Check if the response status is OK
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image: received status code %d", resp.StatusCode)
+	}
+
+	if f.maxBytes > 0 && resp.ContentLength > f.maxBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", f.maxBytes)
+	}
+
+	// Read the response body, one byte past the limit to tell when it is exceeded
+	body := io.Reader(resp.Body)
+	if f.maxBytes > 0 {
+		body = io.LimitReader(resp.Body, f.maxBytes+1)
+	}
+
+	data, err = io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image data: %w", err)
+	}
+
+	if f.maxBytes > 0 && int64(len(data)) > f.maxBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", f.maxBytes)
+	}
+
+	span.SetAttributes(semconv.HTTPResponseBodySize(len(data)))
+
+	return data, nil
+}
+
+// Check creates and removes a file in the directory of st, to tell whether
+// images can be saved
+func (st *Storage) Check() error {
+	if err := os.MkdirAll(st.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(st.dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// SaveImage saves the image of ih to a file in its format (PNG or JPEG).
+func (st *Storage) SaveImage(ctx context.Context, ih *ImageHolder, documentID, storeID string) (err error) {
 	if documentID == "" || storeID == "" {
 		return fmt.Errorf("documentID and storeID must be provided")
 	}
 
+	ctx, span := tracing.Start(ctx, "SaveImage", trace.WithAttributes(attribute.String("image.format", ih.Format)))
+
+	start := time.Now()
+	defer func() {
+		metrics.ImageSaveDuration.Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
 	// Create the directory structure
-	dirPath := filepath.Join("./files", documentID, storeID)
+	dirPath := filepath.Join(st.dir, documentID, storeID)
 	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
@@ -92,10 +221,10 @@ func (ih *ImageHolder) SaveImage(documentID, storeID string) error {
 	// Determine the format based on the Format field
 	switch ih.Format {
 	case "png":
-		logger.GetLogger().Log(fmt.Sprintf("Saving file %v.png", ih.ID))
+		logger.FromContext(ctx).Debug("Saving file", "file", ih.ID+".png")
 		return png.Encode(outFile, ih.Image)
 	case "jpeg":
-		logger.GetLogger().Log(fmt.Sprintf("Saving file %v.jpeg", ih.ID))
+		logger.FromContext(ctx).Debug("Saving file", "file", ih.ID+".jpeg")
 		return jpeg.Encode(outFile, ih.Image, nil)
 	default:
 		return fmt.Errorf("unsupported image format: %s", ih.Format)
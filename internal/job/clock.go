@@ -0,0 +1,30 @@
+package job
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Clock tells the time and waits, a Processor uses it for the processing
+// delay and the durations it reports so that tests can control both
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Rand draws the random processing delay of an image
+type Rand interface {
+	// IntN returns a number in [0, n)
+	IntN(n int) int
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// globalRand draws from the top-level functions of math/rand/v2, which are
+// safe for concurrent use
+type globalRand struct{}
+
+func (globalRand) IntN(n int) int { return rand.IntN(n) }
@@ -1,38 +1,166 @@
 package job
 
 import (
+	"context"
 	"fmt"
+	"image-job-processor/internal/events"
 	"image-job-processor/internal/files"
 	"image-job-processor/internal/logger"
+	"image-job-processor/internal/metrics"
 	"image-job-processor/internal/model"
 	"image-job-processor/internal/service"
 	"image-job-processor/internal/store"
-	"math/rand/v2"
+	"image-job-processor/internal/tracing"
+	"image-job-processor/internal/webhook"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Dependencies of a Processor
+type Dependencies struct {
+	// Jobs are read and updated in this repository
+	Jobs service.JobRepository
+	// Stores resolves the store IDs of the visits
+	Stores *store.StoreManager
+	// Fetcher downloads the images and Storage saves them
+	Fetcher *files.Fetcher
+	Storage *files.Storage
+	// Broker receives the progress of the jobs
+	Broker events.Broker
+	// Webhooks posts the callbacks of finished jobs
+	Webhooks *webhook.Deliverer
+	Log      *logger.Logger
+	// DBRetry retries the database writes failing with a transient error
+	DBRetry RetryPolicy
+	// Lease holds the jobs processed, it is given up on the jobs whose final
+	// status can not be saved
+	Lease Lease
+	// Clock and Rand time the simulated processing of the images, the system
+	// clock and math/rand/v2 when nil
+	Clock Clock
+	Rand  Rand
+}
+
+// Processor processes jobs with the dependencies it was created with
+type Processor struct {
+	jobs     service.JobRepository
+	stores   *store.StoreManager
+	fetcher  *files.Fetcher
+	storage  *files.Storage
+	broker   events.Broker
+	webhooks *webhook.Deliverer
+	log      *logger.Logger
+	dbRetry  RetryPolicy
+	lease    Lease
+	clock    Clock
+	rand     Rand
+}
+
+// NewProcessor creates a Processor using deps
+func NewProcessor(deps Dependencies) *Processor {
+	p := &Processor{
+		jobs:     deps.Jobs,
+		stores:   deps.Stores,
+		fetcher:  deps.Fetcher,
+		storage:  deps.Storage,
+		broker:   deps.Broker,
+		webhooks: deps.Webhooks,
+		log:      deps.Log,
+		dbRetry:  deps.DBRetry,
+		lease:    deps.Lease,
+		clock:    deps.Clock,
+		rand:     deps.Rand,
+	}
+	if p.clock == nil {
+		p.clock = systemClock{}
+	}
+	if p.rand == nil {
+		p.rand = globalRand{}
+	}
+
+	return p
+}
+
 // assumes that storesVisit has been validated by the caller
-// and this id is marked as ongoing in db
-func ProcessJob(id primitive.ObjectID, sv model.StoresVisit) {
+// and this id is marked as ongoing in db.
+// When ctx is cancelled the images processed so far are saved and the job is
+// left ongoing, to be resumed by the next ProcessJob call for this id.
+func (p *Processor) ProcessJob(ctx context.Context, id primitive.ObjectID, sv model.StoresVisit) {
 
-	logger.GetLogger().Log(fmt.Sprintf("Starting new job for id %v", id.Hex()))
+	// every message of this job carries its id and the request that submitted it
+	log := p.log.With("job_id", id.Hex())
+	if sv.RequestID != "" {
+		log = log.With("request_id", sv.RequestID)
+	}
 
-	sm, err := store.NewStoreManager()
+	// the job runs after the submit request has returned, so it starts its own
+	// trace linked to the request's
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithAttributes(attribute.String("job.id", id.Hex())),
+	}
+	if link, err := tracing.Link(sv.TraceContext); err == nil {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	ctx, span := tracing.Start(ctx, "ProcessJob", opts...)
+	defer span.End()
 
-	if err != nil {
-		fmt.Println(err)
-		return
+	if sc := span.SpanContext(); sc.IsValid() {
+		log = log.With("trace_id", sc.TraceID().String())
+	}
+	ctx = logger.NewContext(ctx, log)
+
+	// database writes must land even when ctx is cancelled by a shutdown
+	dbCtx := context.WithoutCancel(ctx)
+
+	metrics.JobsActive.Inc()
+	defer metrics.JobsActive.Dec()
+
+	// a job checkpointed or released is no longer processed here, its last
+	// event must not outlive it
+	defer p.broker.Forget(id.Hex())
+
+	start := p.clock.Now()
+
+	// progress reported to subscribers of this job
+	ev := events.Event{
+		Type:        events.TypeProgress,
+		JobID:       id.Hex(),
+		VisitsTotal: len(sv.Visits),
+	}
+	for _, v := range sv.Visits {
+		ev.ImagesTotal += len(v.ImageURLs)
+		ev.ImagesProcessed += len(v.ImageUUIDs)
 	}
 
-	svs := service.NewStoresVisitService()
+	log.Info("Starting job", "visits", ev.VisitsTotal, "images", ev.ImagesTotal, "already_processed", ev.ImagesProcessed)
+
+	if p.stores.Info().Version == 0 {
+		err := p.stores.LastError()
+		p.finishJob(ctx, id, sv, ev, start, "failed", metrics.ReasonStoreMaster, fmt.Sprintf("store master is not available: %v", err), "")
+		return
+	}
 
 	for visitIndex, store := range sv.Visits {
 
-		if !sm.StoreIDExists(store.StoreID) {
-			svs.UpdateStoresVisitStatus(id, "failed", "store ID does not exist", store.StoreID)
-			logger.GetLogger().Log(fmt.Sprintf("Failed job for id %v", id.Hex()))
+		ev.VisitIndex = visitIndex
+		ev.StoreID = store.StoreID
+
+		visitCtx, visitSpan := tracing.Start(ctx, "ProcessVisit", trace.WithAttributes(
+			attribute.String("store.id", store.StoreID),
+			attribute.Int("visit.index", visitIndex),
+			attribute.Int("visit.images", len(store.ImageURLs)),
+		))
+
+		storeInfo, exists := p.stores.GetStore(store.StoreID)
+
+		if !exists {
+			visitSpan.End()
+			p.finishJob(ctx, id, sv, ev, start, "failed", metrics.ReasonUnknownStore, "store ID does not exist", store.StoreID)
 			return
 		}
 
@@ -52,42 +180,161 @@ func ProcessJob(id primitive.ObjectID, sv model.StoresVisit) {
 				continue
 			}
 
-			img_holder, err := files.DownloadImage(img_url)
+			if ctx.Err() != nil {
+				visitSpan.End()
+				p.checkpointJob(dbCtx, id, visitIndex, new_image_perims[:i], new_image_uuids[:i], storeInfo)
+				return
+			}
+
+			imageStart := p.clock.Now()
+
+			img_holder, err := p.fetcher.DownloadImage(visitCtx, img_url)
+
+			// a download cut short by a shutdown is retried on resume
+			if err != nil && ctx.Err() != nil {
+				visitSpan.End()
+				p.checkpointJob(dbCtx, id, visitIndex, new_image_perims[:i], new_image_uuids[:i], storeInfo)
+				return
+			}
 
 			if err != nil {
-				svs.UpdateStoresVisitStatus(id, "failed", err.Error(), store.StoreID)
-				logger.GetLogger().Log(fmt.Sprintf("Failed job for id %v", id.Hex()))
+				tracing.End(visitSpan, err)
+				log.Warn("Failed to download image", "store_id", store.StoreID, "url", img_url, "duration", p.clock.Now().Sub(imageStart), "error", err)
+				p.finishJob(ctx, id, sv, ev, start, "failed", metrics.ReasonDownload, err.Error(), store.StoreID)
 				return
 			}
 
-			err = img_holder.SaveImage(id.Hex(), store.StoreID)
+			err = p.storage.SaveImage(visitCtx, img_holder, id.Hex(), store.StoreID)
 
 			if err != nil {
-				svs.UpdateStoresVisitStatus(id, "failed", err.Error(), store.StoreID)
-				logger.GetLogger().Log(fmt.Sprintf("Failed job for id %v", id.Hex()))
+				tracing.End(visitSpan, err)
+				log.Error("Failed to save image", "store_id", store.StoreID, "url", img_url, "error", err)
+				p.finishJob(ctx, id, sv, ev, start, "failed", metrics.ReasonSave, err.Error(), store.StoreID)
 				return
 			}
 
 			// calculate perimeter
 			perim := int64(img_holder.Width) * int64(img_holder.Height)
 
-			// gpu processing simulation
-			ms := 100 + rand.IntN(301)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			// gpu processing simulation, the image is kept even if ctx is
+			// cancelled meanwhile
+			ms := 100 + p.rand.IntN(301)
+			select {
+			case <-p.clock.After(time.Duration(ms) * time.Millisecond):
+			case <-ctx.Done():
+			}
 
 			new_image_perims[i] = perim
 			new_image_uuids[i] = fmt.Sprintf("%s.%s", img_holder.ID, img_holder.Format)
+
+			log.Debug("Processed image", "store_id", store.StoreID, "url", img_url, "duration", p.clock.Now().Sub(imageStart))
+
+			ev.ImagesProcessed++
+			p.broker.Publish(ev)
 		}
 
 		// store the new image perims and uuids in db
-		err = svs.UpdateVisitInfo(id, visitIndex, new_image_perims, new_image_uuids)
+		err := p.withRetry(dbCtx, "UpdateVisitInfo", func(ctx context.Context) error {
+			return p.jobs.UpdateVisitInfo(ctx, id, visitIndex, new_image_perims, new_image_uuids, storeInfo)
+		})
+		tracing.End(visitSpan, err)
 		if err != nil {
-			fmt.Println(err)
-			logger.GetLogger().Log(fmt.Sprintf("Failed job for id %v", id.Hex()))
+			log.Error("Failed to save visit", "store_id", store.StoreID, "error", err)
+			p.finishJob(ctx, id, sv, ev, start, "failed", metrics.ReasonDatabase, fmt.Sprintf("failed to save the processed images: %v", err), store.StoreID)
 			return
 		}
 	}
 
-	svs.UpdateStoresVisitStatus(id, "completed", "", "")
-	logger.GetLogger().Log(fmt.Sprintf("Completed job for id %v", id.Hex()))
+	ev.StoreID = ""
+	p.finishJob(ctx, id, sv, ev, start, "completed", "", "", "")
+}
+
+// checkpointJob saves the images of a visit processed before the job was interrupted
+func (p *Processor) checkpointJob(ctx context.Context, id primitive.ObjectID, visitIndex int, perims []int64, uuids []string, storeInfo model.Store) {
+	log := logger.FromContext(ctx).With("store_id", storeInfo.ID, "visit_index", visitIndex)
+
+	err := p.withRetry(ctx, "UpdateVisitInfo", func(ctx context.Context) error {
+		return p.jobs.UpdateVisitInfo(ctx, id, visitIndex, perims, uuids, storeInfo)
+	})
+	if err != nil {
+		log.Error("Failed to checkpoint job", "error", err)
+		return
+	}
+
+	log.Warn("Interrupted job, it will be resumed", "images_done", len(uuids))
+}
+
+// finishJob moves the job to a terminal state and notifies the callback url, if any.
+// reason is one of the metrics.Reason values for failed jobs.
+func (p *Processor) finishJob(ctx context.Context, id primitive.ObjectID, sv model.StoresVisit, ev events.Event, start time.Time, status, reason, errMssg, failedStoreID string) {
+	log := logger.FromContext(ctx)
+
+	// the outcome must be recorded even if the job was cancelled meanwhile
+	ctx = context.WithoutCancel(ctx)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("job.status", status))
+	if status == "failed" {
+		span.SetAttributes(attribute.String("job.failure_reason", reason))
+		span.SetStatus(codes.Error, errMssg)
+	}
+
+	err := p.withRetry(ctx, "UpdateStoresVisitStatus", func(ctx context.Context) error {
+		return p.jobs.UpdateStoresVisitStatus(ctx, id, status, errMssg, failedStoreID)
+	})
+	if err != nil {
+		log.Error("Failed to save job status", "status", status, "error", err)
+		p.releaseJob(ctx, id)
+		return
+	}
+
+	ev.Type = status
+	ev.Error = errMssg
+	p.broker.Publish(ev)
+
+	metrics.JobDuration.WithLabelValues(status).Observe(p.clock.Now().Sub(start).Seconds())
+
+	if status == "completed" {
+		metrics.JobsCompleted.Inc()
+		log.Info("Completed job", "images_processed", ev.ImagesProcessed, "duration", p.clock.Now().Sub(start))
+	} else {
+		metrics.JobsFailed.WithLabelValues(reason).Inc()
+		log.Warn("Failed job", "store_id", failedStoreID, "error", errMssg, "duration", p.clock.Now().Sub(start))
+	}
+
+	if sv.CallbackURL == "" {
+		return
+	}
+
+	// re-read the job so the summary reflects the images stored so far
+	var final *model.StoresVisit
+	err = p.withRetry(ctx, "FindStoresVisitByID", func(ctx context.Context) error {
+		var err error
+		final, err = p.jobs.FindStoresVisitByID(ctx, id)
+		return err
+	})
+	if err != nil {
+		log.Error("Failed to load job for callback", "error", err)
+		return
+	}
+
+	// the delivery outlives the job, ctx no longer carries its cancellation
+	p.webhooks.Send(ctx, id, sv.CallbackURL, webhook.NewPayload(id, final))
+}
+
+// releaseJob gives up the lease on a job left ongoing because its final status
+// could not be saved, so that it is claimed and processed again by an instance
+// resuming jobs instead of staying ongoing while this one runs. If the lease
+// can not be given up either, the job is claimed once the lease expires, as it
+// is no longer renewed, by this instance as well.
+func (p *Processor) releaseJob(ctx context.Context, id primitive.ObjectID) {
+	err := p.withRetry(ctx, "ReleaseLeases", func(ctx context.Context) error {
+		return p.jobs.ReleaseLeases(ctx, p.lease.Owner, id)
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to release job lease, the job is resumed once it expires", "error", err)
+		return
+	}
+
+	logger.FromContext(ctx).Warn("Released job lease, the job will be resumed")
 }
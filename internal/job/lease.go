@@ -0,0 +1,34 @@
+package job
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Lease identifies the instance holding the ongoing jobs it processes or has
+// queued, so that instances sharing the jobs never process the same one. The
+// instance renews its leases while it runs, the jobs of an instance that
+// stopped can be claimed by another once their leases expire.
+type Lease struct {
+	// Owner is unique to the instance
+	Owner string
+	// TTL is how long a lease lasts without being renewed
+	TTL time.Duration
+}
+
+// NewLease creates a Lease with a random owner
+func NewLease(ttl time.Duration) Lease {
+	return Lease{Owner: uuid.NewString(), TTL: ttl}
+}
+
+// Until returns when a lease taken or renewed now expires
+func (l Lease) Until() time.Time {
+	return time.Now().Add(l.TTL)
+}
+
+// RenewInterval returns how often the leases are renewed, often enough for a
+// couple of failed renewals not to lose them
+func (l Lease) RenewInterval() time.Duration {
+	return l.TTL / 3
+}
@@ -0,0 +1,189 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"image-job-processor/internal/metrics"
+	"image-job-processor/internal/model"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrQueueFull is returned by Enqueue when no more jobs can wait for a worker
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrPoolStopped is returned by Enqueue once Shutdown has been called
+var ErrPoolStopped = errors.New("job pool is shutting down")
+
+type task struct {
+	id primitive.ObjectID
+	sv model.StoresVisit
+}
+
+// Pool runs the jobs of a Processor on a fixed number of workers fed by a
+// bounded queue
+type Pool struct {
+	processor *Processor
+	workers   int
+
+	tasks chan task
+
+	// mu guards stopped, so that tasks is never sent on after it is closed
+	mu      sync.RWMutex
+	stopped bool
+
+	// held are the jobs queued or running, whose leases are kept
+	heldMu sync.Mutex
+	held   map[primitive.ObjectID]struct{}
+
+	// ctx is cancelled when the shutdown deadline passes, interrupting running jobs
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// NewPool starts workers processing the jobs given to Enqueue with processor.
+// Up to queueSize jobs can wait for a worker.
+func NewPool(processor *Processor, workers, queueSize int) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		processor: processor,
+		workers:   workers,
+		tasks:     make(chan task, queueSize),
+		held:      make(map[primitive.ObjectID]struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	p.running.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	p.processor.log.Info("Started job workers", "workers", workers, "queue_size", queueSize)
+
+	return p
+}
+
+func (p *Pool) work() {
+	defer p.running.Done()
+
+	for t := range p.tasks {
+		metrics.JobQueueDepth.Dec()
+
+		// past the shutdown deadline queued jobs stay ongoing and are resumed on the next start
+		if p.ctx.Err() == nil {
+			p.processor.ProcessJob(p.ctx, t.id, t.sv)
+		}
+		p.release(t.id)
+	}
+}
+
+// Enqueue queues a job for processing. It does not block, ErrQueueFull is
+// returned when all workers are busy and the queue is full.
+func (p *Pool) Enqueue(id primitive.ObjectID, sv model.StoresVisit) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return ErrPoolStopped
+	}
+
+	// counted before the send so a worker taking it right away never sees a negative depth
+	metrics.JobQueueDepth.Inc()
+	p.hold(id)
+
+	select {
+	case p.tasks <- task{id: id, sv: sv}:
+		return nil
+	default:
+		metrics.JobQueueDepth.Dec()
+		p.release(id)
+		return ErrQueueFull
+	}
+}
+
+func (p *Pool) hold(id primitive.ObjectID) {
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+	p.held[id] = struct{}{}
+}
+
+func (p *Pool) release(id primitive.ObjectID) {
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+	delete(p.held, id)
+}
+
+// Held returns the jobs queued or running, a job is held until ProcessJob
+// returns for it
+func (p *Pool) Held() []primitive.ObjectID {
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+
+	ids := make([]primitive.ObjectID, 0, len(p.held))
+	for id := range p.held {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Shutdown stops accepting jobs and lets the workers drain the queue until ctx
+// is done. Jobs still running then are interrupted and checkpointed, and jobs
+// still queued are left ongoing. It returns once every worker has stopped, with
+// ctx.Err() if the queue could not be drained in time.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		p.processor.log.Warn("Interrupting running jobs, queued jobs will be resumed on the next start", "queued", len(p.tasks))
+		p.cancel()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// Accepting returns nil if Enqueue would accept a job right now, or why it
+// would not
+func (p *Pool) Accepting() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return ErrPoolStopped
+	}
+	if cap(p.tasks) > 0 && len(p.tasks) >= cap(p.tasks) {
+		return ErrQueueFull
+	}
+
+	return nil
+}
+
+// QueueDepth returns the number of jobs waiting for a worker
+func (p *Pool) QueueDepth() int {
+	return len(p.tasks)
+}
+
+// Workers returns the number of jobs processed concurrently
+func (p *Pool) Workers() int {
+	return p.workers
+}
+
+// QueueSize returns the number of jobs that can wait for a worker
+func (p *Pool) QueueSize() int {
+	return cap(p.tasks)
+}
@@ -0,0 +1,39 @@
+package job
+
+import (
+	"context"
+	"image-job-processor/internal/db"
+	"image-job-processor/internal/logger"
+	"time"
+)
+
+// RetryPolicy retries the database writes of a job
+type RetryPolicy struct {
+	// Attempts is the number of times a write failing with a transient error is tried
+	Attempts int
+	// Backoff is the wait before the first retry, doubled after every attempt
+	Backoff time.Duration
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not
+// transient (see db.IsTransient) or the attempts of the retry policy have been
+// made. It returns the error of the last call.
+func (p *Processor) withRetry(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	backoff := p.dbRetry.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !db.IsTransient(err) || attempt >= p.dbRetry.Attempts {
+			return err
+		}
+
+		logger.FromContext(ctx).Warn("Database call failed, retrying", "operation", operation, "attempt", attempt, "retry_in", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -1,114 +1,322 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"image-job-processor/internal/metrics"
+	"io"
+	"log/slog"
 	"os"
-	"path/filepath"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Logger struct to hold the log channel and the log file
-type Logger struct {
-	logChannel chan string
-	done       chan bool
-}
+// Log levels, lowest first
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+// What to do with a message when the buffer is full
+const (
+	// OverflowDrop discards the message and counts it
+	OverflowDrop = "drop"
+	// OverflowSpill writes the message from the calling goroutine
+	OverflowSpill = "spill"
+)
 
-var (
-	instance *Logger
-	once     sync.Once
+// Where the messages are written
+const (
+	SinkStdout = "stdout"
+	// SinkFile writes to app.log in Settings.Dir
+	SinkFile = "file"
+	SinkBoth = "both"
 )
 
-const bufferSize = 1000
+// LogFileName is the name of the log file in Settings.Dir
+const LogFileName = "app.log"
 
-const LogToFile = false
+// Settings configures a Logger, see DefaultSettings
+type Settings struct {
+	// Sink is SinkStdout, SinkFile or SinkBoth
+	Sink string
+	Dir  string
+	// Format is text (key=value pairs) or json
+	Format string
+	// Level is the lowest level logged, it can be changed later with SetLevel
+	Level slog.Level
+	// Overflow is OverflowDrop or OverflowSpill
+	Overflow string
+	// BufferSize is the number of messages waiting to be written
+	BufferSize int
 
-// NewLogger initializes a new Logger
-func newLogger() *Logger {
-	l := &Logger{
-		logChannel: make(chan string, bufferSize),
-		done:       make(chan bool),
+	// Log file rotation, a zero value disables the limit
+
+	// MaxSize rotates the file before it grows past this many bytes
+	MaxSize int64
+	// RotateInterval rotates the file when the interval, aligned to UTC, ends
+	RotateInterval time.Duration
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int
+	// MaxAge removes rotated files older than this
+	MaxAge time.Duration
+}
+
+// DefaultSettings returns the settings of a text Logger writing to stdout
+func DefaultSettings() Settings {
+	return Settings{
+		Sink:       SinkStdout,
+		Dir:        "logs",
+		Format:     "text",
+		Level:      LevelInfo,
+		Overflow:   OverflowDrop,
+		BufferSize: 1000,
+		MaxSize:    100 << 20,
+		MaxBackups: 10,
 	}
-	go l.startLogging()
-	return l
 }
 
-// startLogging listens for log messages and writes them to a file
-func (l *Logger) startLogging() {
+// core is shared by a Logger and every Logger derived from it with With
+type core struct {
+	// level drops messages below it before they are queued, it can be changed at any time
+	level    slog.LevelVar
+	overflow string
 
-	if LogToFile {
-		logsDir := "logs"
+	records chan slog.Record
+	handler slog.Handler
+	closer  io.Closer
 
-		// Get the current working directory
-		currentDir, err := os.Getwd()
-		if err != nil {
-			fmt.Println("Error getting current directory:", err)
-			return
-		}
+	done    chan bool
+	stopped chan struct{}
 
-		// Create the full path for the logs directory
-		logsPath := filepath.Join(currentDir, logsDir)
+	dropped  atomic.Uint64
+	spilled  atomic.Uint64
+	reported uint64
+}
 
-		// Check if the directory exists
-		if _, err := os.Stat(logsPath); os.IsNotExist(err) {
-			// Create the logs directory
-			err := os.Mkdir(logsPath, 0755) // 0755 is the permission mode
-			if err != nil {
-				fmt.Println("Error creating logs directory:", err)
-				return
-			}
-		}
+// Logger writes leveled messages with key/value fields asynchronously.
+// Callers never wait for the write, see Overflow for what happens when the
+// buffer is full.
+type Logger struct {
+	core   *core
+	fields []any
+}
+
+// New starts a Logger, Stop must be called to write the buffered messages
+// and close the log file
+func New(settings Settings) *Logger {
+	var w io.Writer = os.Stdout
+	var closer io.Closer
 
-		file, err := os.OpenFile("./logs/app.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if settings.Sink == SinkFile || settings.Sink == SinkBoth {
+		file, err := newRotatingFile(settings.Dir, LogFileName, settings.MaxSize, settings.RotateInterval, settings.MaxBackups, settings.MaxAge)
 		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-
-		for {
-			select {
-			case msg := <-l.logChannel:
-				_, err := file.WriteString(fmt.Sprintf("%s: %s\n", time.Now().Format(time.RFC3339), msg))
-				if err != nil {
-					log.Println("Error writing to log file:", err)
-				}
-			case <-l.done:
-				return
-			}
+			fmt.Fprintln(os.Stderr, "Error opening log file, logging to stdout:", err)
+		} else if settings.Sink == SinkBoth {
+			w = io.MultiWriter(os.Stdout, file)
+			closer = file
+		} else {
+			w = file
+			closer = file
 		}
+	}
+
+	s := &core{
+		overflow: settings.Overflow,
+		records:  make(chan slog.Record, max(settings.BufferSize, 0)),
+		closer:   closer,
+		done:     make(chan bool),
+		stopped:  make(chan struct{}),
+	}
+	s.level.Set(settings.Level)
+
+	opts := &slog.HandlerOptions{Level: &s.level}
+	if settings.Format == "json" {
+		s.handler = slog.NewJSONHandler(w, opts)
 	} else {
-		for {
-			select {
-			case msg := <-l.logChannel:
-				// Output log message to stdout
-				_, err := fmt.Printf("%s: %s\n", time.Now().Format(time.RFC3339), msg)
-				if err != nil {
-					log.Println("Error writing to stdout:", err)
-				}
-			case <-l.done:
-				return
+		s.handler = slog.NewTextHandler(w, opts)
+	}
+
+	go s.startLogging()
+
+	return &Logger{core: s}
+}
+
+// startLogging writes the queued messages until Stop is called
+func (s *core) startLogging() {
+	defer close(s.stopped)
+
+	for {
+		select {
+		case r := <-s.records:
+			s.write(r)
+			s.reportDropped()
+		case <-s.done:
+			s.flush()
+			s.reportDropped()
+			if s.closer != nil {
+				s.closer.Close()
 			}
+			return
 		}
+	}
+}
+
+func (s *core) write(r slog.Record) {
+	if err := s.handler.Handle(context.Background(), r); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing log message:", err)
+	}
+}
+
+// flush writes the messages still buffered
+func (s *core) flush() {
+	for {
+		select {
+		case r := <-s.records:
+			s.write(r)
+		default:
+			return
+		}
+	}
+}
+
+// reportDropped logs how many messages were dropped since the last report
+func (s *core) reportDropped() {
+	dropped := s.dropped.Load()
+	if dropped == s.reported {
+		return
+	}
+
+	r := slog.NewRecord(time.Now(), LevelWarn, "Dropped log messages, the buffer was full", 0)
+	r.Add("dropped", dropped-s.reported, "dropped_total", dropped)
+	s.write(r)
+	s.reported = dropped
+}
+
+// log queues a message, applying the overflow policy when the buffer is full
+func (l *Logger) log(lvl slog.Level, msg string, args []any) {
+	if lvl < l.core.level.Level() {
+		return
+	}
+
+	select {
+	case <-l.core.stopped:
+		return
+	default:
+	}
+
+	r := slog.NewRecord(time.Now(), lvl, msg, 0)
+	r.Add(l.fields...)
+	r.Add(args...)
 
+	select {
+	case l.core.records <- r:
+	default:
+		if l.core.overflow == OverflowSpill {
+			l.core.spilled.Add(1)
+			metrics.LogMessagesOverflowed.WithLabelValues("spilled").Inc()
+			l.core.write(r)
+			return
+		}
+		l.core.dropped.Add(1)
+		metrics.LogMessagesOverflowed.WithLabelValues("dropped").Inc()
 	}
+}
+
+// Debug logs msg with the given key/value pairs at debug level
+func (l *Logger) Debug(msg string, args ...any) {
+	l.log(LevelDebug, msg, args)
+}
 
+// Info logs msg with the given key/value pairs at info level
+func (l *Logger) Info(msg string, args ...any) {
+	l.log(LevelInfo, msg, args)
 }
 
-// Log sends a log message to the log channel
-func (l *Logger) Log(message string) {
-	l.logChannel <- message
+// Warn logs msg with the given key/value pairs at warn level
+func (l *Logger) Warn(msg string, args ...any) {
+	l.log(LevelWarn, msg, args)
+}
+
+// Error logs msg with the given key/value pairs at error level
+func (l *Logger) Error(msg string, args ...any) {
+	l.log(LevelError, msg, args)
+}
+
+// With returns a Logger that adds the given key/value pairs to every message
+func (l *Logger) With(args ...any) *Logger {
+	fields := make([]any, 0, len(l.fields)+len(args))
+	fields = append(fields, l.fields...)
+	fields = append(fields, args...)
+
+	return &Logger{core: l.core, fields: fields}
 }
 
-// Stop stops the logger
+// Dropped returns the number of messages discarded because the buffer was full
+func (l *Logger) Dropped() uint64 {
+	return l.core.dropped.Load()
+}
+
+// Spilled returns the number of messages written by their caller because the buffer was full
+func (l *Logger) Spilled() uint64 {
+	return l.core.spilled.Load()
+}
+
+// Stop stops the logger once the buffered messages have been written.
+// Messages logged after Stop are not written.
 func (l *Logger) Stop() {
-	l.done <- true
+	select {
+	case l.core.done <- true:
+		<-l.core.stopped
+	case <-l.core.stopped:
+	}
 }
 
-// GetLogger returns the singleton instance of Logger
-func GetLogger() *Logger {
-	once.Do(func() {
-		instance = newLogger()
-	})
-	return instance
+// ParseLevel converts debug, info, warn or error to a level
+func ParseLevel(s string) (slog.Level, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(s))
+	return lvl, err
+}
+
+// SetLevel changes the lowest level logged by l and every Logger sharing its
+// output, it takes effect right away
+func (l *Logger) SetLevel(lvl slog.Level) {
+	l.core.level.Set(lvl)
+}
+
+// Level returns the lowest level logged
+func (l *Logger) Level() slog.Level {
+	return l.core.level.Level()
+}
+
+// Discard returns a Logger that writes nothing, it does not need to be stopped
+func Discard() *Logger {
+	s := &core{
+		done:    make(chan bool),
+		stopped: make(chan struct{}),
+	}
+	close(s.stopped)
+	return &Logger{core: s}
+}
+
+type contextKey struct{}
+
+// discard is returned by FromContext for the contexts without a Logger
+var discard = Discard()
+
+// NewContext returns a copy of ctx carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the Logger carried by ctx. Without one the messages are
+// discarded, the Logger of the App is attached to the contexts it hands out.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return discard
 }
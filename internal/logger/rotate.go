@@ -0,0 +1,196 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names the rotated files, it sorts in chronological order
+const backupTimeFormat = "20060102T150405.000"
+
+// rotateRetryDelay is how long a failed rotation waits before being tried
+// again, meanwhile the current file is written to
+const rotateRetryDelay = time.Minute
+
+// rotatingFile is an io.Writer appending to dir/name. The file is renamed to
+// name-<time>.ext and a new one started when it would grow past maxSize or
+// when the current interval ends. Rotated files beyond maxBackups or older
+// than maxAge are removed. A zero limit disables it.
+type rotatingFile struct {
+	dir        string
+	name       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// renamed is set once file has been renamed by a rotation whose new file
+	// could not be opened yet
+	renamed bool
+	// retryAt delays the rotation after a failed one
+	retryAt time.Time
+}
+
+func newRotatingFile(dir, name string, maxSize int64, interval time.Duration, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	if !filepath.IsAbs(dir) {
+		// Get the current working directory
+		currentDir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(currentDir, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	rf := &rotatingFile{
+		dir:        dir,
+		name:       name,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// open appends to the current file, an existing file keeps counting from its
+// size and modification time so restarts do not delay the rotation. The file
+// written to so far, if any, is only closed once the new one is open.
+func (rf *rotatingFile) open() error {
+	path := filepath.Join(rf.dir, rf.name)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if rf.file != nil {
+		rf.file.Close()
+	}
+
+	rf.file = file
+	rf.renamed = false
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	if rf.size > 0 {
+		rf.openedAt = info.ModTime()
+	}
+
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			rf.retryAt = time.Now().Add(rotateRetryDelay)
+			fmt.Fprintf(os.Stderr, "Error rotating log file, retrying in %s: %v\n", rotateRetryDelay, err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) shouldRotate(next int64) bool {
+	if rf.size == 0 || time.Now().Before(rf.retryAt) {
+		return false
+	}
+
+	if rf.maxSize > 0 && rf.size+next > rf.maxSize {
+		return true
+	}
+
+	// intervals are aligned to UTC, a 24h interval rotates at midnight UTC
+	if rf.interval > 0 && !time.Now().Truncate(rf.interval).Equal(rf.openedAt.Truncate(rf.interval)) {
+		return true
+	}
+
+	return false
+}
+
+// rotate renames the current file and starts a new one. The current file stays
+// open until then, so that messages keep being written to it if either step
+// fails: a failed rename leaves it in place, a failed open leaves it renamed
+// and only the open is tried again.
+func (rf *rotatingFile) rotate() error {
+	if !rf.renamed {
+		ext := filepath.Ext(rf.name)
+		backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(rf.name, ext), time.Now().UTC().Format(backupTimeFormat), ext)
+
+		if err := os.Rename(filepath.Join(rf.dir, rf.name), filepath.Join(rf.dir, backup)); err != nil {
+			return err
+		}
+		rf.renamed = true
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.prune()
+	return nil
+}
+
+// prune removes the rotated files beyond maxBackups or older than maxAge
+func (rf *rotatingFile) prune() {
+	if rf.maxBackups <= 0 && rf.maxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(rf.name)
+	backups, err := filepath.Glob(filepath.Join(rf.dir, strings.TrimSuffix(rf.name, ext)+"-*"+ext))
+	if err != nil {
+		return
+	}
+
+	// newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		remove := rf.maxBackups > 0 && i >= rf.maxBackups
+
+		if !remove && rf.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > rf.maxAge {
+				remove = true
+			}
+		}
+
+		if remove {
+			os.Remove(backup)
+		}
+	}
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.file.Close()
+}
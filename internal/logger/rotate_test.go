@@ -0,0 +1,191 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// backups returns the names of the rotated files in dir, oldest first
+func backups(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(matches))
+	for i, match := range matches {
+		names[i] = filepath.Base(match)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func write(t *testing.T, rf *rotatingFile, msg string) {
+	t.Helper()
+
+	if _, err := rf.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateOnSize(t *testing.T) {
+	dir := t.TempDir()
+
+	rf, err := newRotatingFile(dir, LogFileName, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	write(t, rf, "first\n")
+	write(t, rf, "abc\n")
+	if got := backups(t, dir); len(got) != 0 {
+		t.Fatalf("rotated before the file is full: %v", got)
+	}
+
+	// would grow the file to 15 bytes
+	write(t, rf, "second\n")
+
+	got := backups(t, dir)
+	if len(got) != 1 {
+		t.Fatalf("want 1 rotated file, got %v", got)
+	}
+	if content := readFile(t, filepath.Join(dir, got[0])); content != "first\nabc\n" {
+		t.Errorf("rotated file has %q", content)
+	}
+	if content := readFile(t, filepath.Join(dir, LogFileName)); content != "second\n" {
+		t.Errorf("current file has %q", content)
+	}
+}
+
+// oldBackups are earlier rotations, the first one past a day old
+var oldBackups = []string{
+	"app-20240101T000000.000.log",
+	"app-20240102T000000.000.log",
+	"app-20240103T000000.000.log",
+}
+
+// seedBackups writes oldBackups and a file the rotation must leave alone to a
+// new directory
+func seedBackups(t *testing.T) (dir, other string) {
+	t.Helper()
+
+	dir = t.TempDir()
+	for _, name := range oldBackups {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, oldBackups[0]), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	other = filepath.Join(dir, "other.log")
+	if err := os.WriteFile(other, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return dir, other
+}
+
+func TestRotatePrunesOldFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		maxAge     time.Duration
+	}{
+		{name: "max backups", maxBackups: 3},
+		{name: "max age", maxAge: 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, other := seedBackups(t)
+
+			rf, err := newRotatingFile(dir, LogFileName, 10, 0, tt.maxBackups, tt.maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rf.Close()
+
+			write(t, rf, "0123456789")
+			write(t, rf, "next\n")
+
+			// the oldest is removed, the newest is the one just rotated
+			got := backups(t, dir)
+			if len(got) != 3 || got[0] != oldBackups[1] || got[1] != oldBackups[2] {
+				t.Errorf("want %v and the new rotated file, got %v", oldBackups[1:], got)
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("unrelated file removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotateRetriesFailedOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, LogFileName)
+
+	rf, err := newRotatingFile(dir, LogFileName, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	write(t, rf, "0123456789")
+
+	// the rename succeeds but a directory takes the place of the new file
+	if err := os.Rename(path, filepath.Join(dir, "app-20240101T000000.000.log")); err != nil {
+		t.Fatal(err)
+	}
+	rf.renamed = true
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, rf, "kept\n")
+	if rf.retryAt.IsZero() {
+		t.Fatal("failed rotation is not delayed")
+	}
+	if content := readFile(t, filepath.Join(dir, "app-20240101T000000.000.log")); content != "0123456789kept\n" {
+		t.Errorf("message not written to the renamed file: %q", content)
+	}
+
+	// within the delay the rotation is not tried again
+	write(t, rf, "wait\n")
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Fatalf("rotation retried before the delay: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	rf.retryAt = time.Now().Add(-time.Second)
+
+	write(t, rf, "retried\n")
+	if rf.renamed {
+		t.Error("the renamed file is still written to")
+	}
+	if content := readFile(t, path); content != "retried\n" {
+		t.Errorf("new file has %q", content)
+	}
+	if got := backups(t, dir); len(got) != 1 {
+		t.Errorf("the renamed file is renamed again: %v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// namespace prefixes every metric, matching the IJP_ environment variables
+const namespace = "ijp"
+
+// Reasons a job fails, kept to a fixed set to bound the label values
+const (
+	ReasonQueueFull    = "queue_full"
+	ReasonStoreMaster  = "store_master_unavailable"
+	ReasonUnknownStore = "unknown_store"
+	ReasonDownload     = "download"
+	ReasonSave         = "save"
+	ReasonDatabase     = "database"
+)
+
+// Jobs
+var (
+	JobsSubmitted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_submitted_total",
+		Help:      "Jobs accepted by the submit endpoint.",
+	})
+
+	JobsCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_completed_total",
+		Help:      "Jobs that processed every image.",
+	})
+
+	JobsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_failed_total",
+		Help:      "Jobs that failed, by reason.",
+	}, []string{"reason"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_processing_duration_seconds",
+		Help:      "Time from the start of processing to a terminal state, by status.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"status"})
+
+	JobsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jobs_active",
+		Help:      "Jobs being processed by a worker.",
+	})
+
+	JobQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_queue_depth",
+		Help:      "Jobs waiting for a worker.",
+	})
+)
+
+// Images
+var (
+	ImageDownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_download_duration_seconds",
+		Help:      "Time to download and decode an image, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"result"})
+
+	ImageDownloadBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_download_bytes",
+		Help:      "Size of the downloaded images.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+
+	ImageSaveDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_save_duration_seconds",
+		Help:      "Time to encode and write an image to the storage directory.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+)
+
+// Database
+var MongoOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "mongo_operation_duration_seconds",
+	Help:      "Time spent in MongoDB calls, by service operation.",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+}, []string{"operation"})
+
+// HTTP
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to handle HTTP requests, by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// Logging
+var LogMessagesOverflowed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "log_messages_overflowed_total",
+	Help:      "Log messages that did not fit in the buffer, by what was done with them: dropped or spilled.",
+}, []string{"action"})
+
+// ObserveMongo records the duration of a MongoDB operation started at start,
+// meant to be deferred at the top of the operation
+func ObserveMongo(operation string, start time.Time) {
+	MongoOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
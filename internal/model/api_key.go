@@ -0,0 +1,36 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKey authenticates a client. Only the SHA-256 hash of the key is stored,
+// the key itself is shown once, when it is created.
+type APIKey struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	// Owner names the client, every job submitted with the key belongs to it.
+	// A client can hold several keys, e.g. while rotating them.
+	Owner string `bson:"owner" json:"owner"`
+	Name  string `bson:"name,omitempty" json:"name,omitempty"`
+	Hash  string `bson:"hash" json:"-"`
+	// Prefix is the start of the key, to tell keys apart without storing them
+	Prefix string `bson:"prefix" json:"prefix"`
+	// Admin keys see and manage every job, key and store
+	Admin bool `bson:"admin" json:"admin"`
+	// Limits replace the default limits of the submissions made with the key
+	Limits    *Limits   `bson:"limits,omitempty" json:"limits,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// Limits bound the submissions of a client, 0 leaves a limit off
+type Limits struct {
+	// RequestsPerMinute bounds the submit requests, accepted or not
+	RequestsPerMinute int `bson:"requests_per_minute" json:"requests_per_minute"`
+	// ActiveJobs bounds the jobs still ongoing
+	ActiveJobs   int `bson:"active_jobs" json:"active_jobs"`
+	ImagesPerJob int `bson:"images_per_job" json:"images_per_job"`
+	// ImagesPerDay bounds the images submitted since midnight UTC
+	ImagesPerDay int `bson:"images_per_day" json:"images_per_day"`
+}
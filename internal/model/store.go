@@ -0,0 +1,9 @@
+package model
+
+// Store is a single row of the store master
+type Store struct {
+	ID       string            `bson:"_id" json:"store_id"`
+	Name     string            `bson:"name" json:"store_name"`
+	AreaCode string            `bson:"area_code" json:"area_code"`
+	Extra    map[string]string `bson:"extra,omitempty" json:"extra,omitempty"`
+}
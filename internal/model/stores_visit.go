@@ -1,20 +1,53 @@
 package model
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type VisitInfo struct {
-	StoreID    string   `bson:"store_id" json:"store_id"`
-	VisitTime  string   `bson:"visit_time" json:"visit_time"`
-	ImageURLs  []string `bson:"image_urls" json:"image_url"`
-	ImageUUIDs []string `bson:"image_uuids"`
-	Perimeters []int64  `bson:"perimeters"`
+	StoreID    string    `bson:"store_id" json:"store_id"`
+	VisitTime  time.Time `bson:"visit_time" json:"visit_time"`
+	ImageURLs  []string  `bson:"image_urls" json:"image_url"`
+	ImageUUIDs []string  `bson:"image_uuids"`
+	Perimeters []int64   `bson:"perimeters"`
+	StoreName  string    `bson:"store_name,omitempty" json:"-"`
+	AreaCode   string    `bson:"area_code,omitempty" json:"-"`
+	// VisitTimeRaw keeps the visit_time stored as a string by older versions,
+	// VisitTime is zero when it was not a valid timestamp
+	VisitTimeRaw string `bson:"visit_time_raw,omitempty" json:"-"`
+}
+
+// CallbackAttempt records a single webhook delivery attempt for a job
+type CallbackAttempt struct {
+	Attempt    int       `bson:"attempt" json:"attempt"`
+	Time       time.Time `bson:"time" json:"time"`
+	StatusCode int       `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	Delivered  bool      `bson:"delivered" json:"delivered"`
 }
 
 type StoresVisit struct {
-	ID            primitive.ObjectID `bson:"_id,omitempty"`
-	Status        string             `bson:"status"`
-	Error         string             `bson:"error"`
-	FailedStoreID string             `bson:"failed_store_id"`
-	Count         int                `bson:"count" json:"count"`
-	Visits        []VisitInfo        `bson:"visits" json:"visits"`
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	Status           string             `bson:"status"`
+	Error            string             `bson:"error"`
+	FailedStoreID    string             `bson:"failed_store_id"`
+	Count            int                `bson:"count" json:"count"`
+	Visits           []VisitInfo        `bson:"visits" json:"visits"`
+	CallbackURL      string             `bson:"callback_url,omitempty" json:"callback_url,omitempty"`
+	CallbackAttempts []CallbackAttempt  `bson:"callback_attempts,omitempty"`
+	// Owner of the API key the job was submitted with, empty when authentication is disabled
+	Owner string `bson:"owner,omitempty" json:"-"`
+	// APIKeyID of the key the job was submitted with, the quotas of the key count the job
+	APIKeyID primitive.ObjectID `bson:"api_key_id,omitempty" json:"-"`
+	// RequestID of the submission, to correlate the logs of the job with it
+	RequestID string `bson:"request_id,omitempty" json:"-"`
+	// TraceContext of the submission, the processing trace links to it
+	TraceContext map[string]string `bson:"trace_context,omitempty" json:"-"`
+	// LeaseOwner is the instance processing the ongoing job, or holding it in
+	// its queue. It renews the lease until the job ends, once LeaseExpiresAt
+	// has passed another instance may claim the job.
+	LeaseOwner     string    `bson:"lease_owner,omitempty" json:"-"`
+	LeaseExpiresAt time.Time `bson:"lease_expires_at,omitempty" json:"-"`
 }
@@ -0,0 +1,135 @@
+package quota
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter counts requests per key in fixed one minute windows, aligned to
+// the minute. Counts are kept in memory, every replica counts its own requests.
+// The windows of past minutes are dropped once a new minute starts, so only
+// the keys seen in the current minute are kept.
+type RateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]window
+	// swept is the start of the minute the past windows were last dropped in
+	swept time.Time
+	now   func() time.Time
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+// NewRateLimiter creates a RateLimiter with no request counted
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		windows: make(map[string]window),
+		now:     time.Now,
+	}
+}
+
+// Allow counts a request of key if fewer than limit were counted in the
+// current minute. Otherwise it returns false and the time left until the next
+// minute. A limit of 0 allows every request without counting it.
+func (rl *RateLimiter) Allow(key string, limit int) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	w := rl.current(key)
+	if w.count >= limit {
+		return false, w.start.Add(time.Minute).Sub(rl.now())
+	}
+
+	w.count++
+	rl.windows[key] = w
+
+	return true, 0
+}
+
+// Count returns the requests of key counted in the current minute, and when
+// the count resets
+func (rl *RateLimiter) Count(key string) (int, time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	w := rl.current(key)
+	return w.count, w.start.Add(time.Minute)
+}
+
+// current returns the window of key for the current minute, rl.mu must be held
+func (rl *RateLimiter) current(key string) window {
+	start := rl.now().Truncate(time.Minute)
+
+	if start.After(rl.swept) {
+		for k, w := range rl.windows {
+			if w.start.Before(start) {
+				delete(rl.windows, k)
+			}
+		}
+		rl.swept = start
+	}
+
+	w, ok := rl.windows[key]
+	if !ok || !w.start.Equal(start) {
+		w = window{start: start}
+	}
+
+	return w
+}
+
+// KeyedMutex serializes the callers holding the same key, e.g. so that two
+// submissions of a client can not both pass a quota only one of them fits in
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu      sync.Mutex
+	holders int
+}
+
+// NewKeyedMutex creates a KeyedMutex with no key locked
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{
+		locks: make(map[string]*keyedLock),
+	}
+}
+
+// Lock locks key and returns the function unlocking it
+func (km *KeyedMutex) Lock(key string) (unlock func()) {
+	km.mu.Lock()
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.holders++
+	km.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		km.mu.Lock()
+		defer km.mu.Unlock()
+
+		// the lock is dropped once nobody holds or waits for it
+		l.holders--
+		if l.holders == 0 {
+			delete(km.locks, key)
+		}
+	}
+}
+
+// NextDay returns midnight UTC after t, when the daily quotas reset
+func NextDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"image-job-processor/internal/logger"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// VisitMetrics maps the name of every per image metric reported by the analytics
+// endpoints to the field of model.VisitInfo holding it. Add newer metrics here.
+var VisitMetrics = map[string]string{
+	"perimeter": "perimeters",
+}
+
+// MetricStats aggregates a single per image metric
+type MetricStats struct {
+	Avg   float64 `bson:"avg" json:"avg"`
+	Count int64   `bson:"count" json:"count"`
+}
+
+// VisitStats aggregates the visits of a store or an area
+type VisitStats struct {
+	Key          string                 `bson:"_id" json:"-"`
+	Stores       int64                  `bson:"stores" json:"stores,omitempty"`
+	Visits       int64                  `bson:"visits" json:"visits"`
+	Images       int64                  `bson:"images" json:"images"`
+	FailedVisits int64                  `bson:"failed_visits" json:"failed_visits"`
+	FailureRate  float64                `bson:"failure_rate" json:"failure_rate"`
+	Metrics      map[string]MetricStats `bson:"metrics" json:"metrics"`
+	LastVisit    *time.Time             `bson:"last_visit" json:"last_visit"`
+}
+
+type AnalyticsService struct {
+	database
+}
+
+// NewAnalyticsService creates a new instance of AnalyticsService
+func NewAnalyticsService(client *mongo.Client, settings Settings) *AnalyticsService {
+	return &AnalyticsService{
+		database: database{client: client, settings: settings},
+	}
+}
+
+// StoreStats aggregates visits per store with a visit time in [from, to).
+// A zero from or to leaves that side of the range open.
+func (as *AnalyticsService) StoreStats(ctx context.Context, from, to time.Time) (stats []VisitStats, err error) {
+	ctx, end := as.startOperation(ctx, "StoreStats", as.jobsCollection())
+	defer func() { end(err) }()
+
+	logger.FromContext(ctx).Debug("Called StoreStats")
+
+	return as.aggregate(ctx, as.visitStatsPipeline(from, to, false))
+}
+
+// AreaStats aggregates visits per area code of the store master, with a visit time in [from, to).
+// Visits of stores missing from the store master are grouped under an empty area code.
+func (as *AnalyticsService) AreaStats(ctx context.Context, from, to time.Time) (stats []VisitStats, err error) {
+	ctx, end := as.startOperation(ctx, "AreaStats", as.jobsCollection())
+	defer func() { end(err) }()
+
+	logger.FromContext(ctx).Debug("Called AreaStats")
+
+	return as.aggregate(ctx, as.visitStatsPipeline(from, to, true))
+}
+
+func (as *AnalyticsService) aggregate(ctx context.Context, pipeline mongo.Pipeline) ([]VisitStats, error) {
+	collection := as.jobsCollection()
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []VisitStats{}
+	if err := cursor.All(ctx, &stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// visitStatsPipeline builds the aggregation shared by the store and area statistics
+func (as *AnalyticsService) visitStatsPipeline(from, to time.Time, byArea bool) mongo.Pipeline {
+	pipeline := mongo.Pipeline{
+		{{Key: "$unwind", Value: "$visits"}},
+		// visit_time may be stored as a string by older documents
+		{{Key: "$addFields", Value: bson.M{
+			"visit_at": bson.M{"$convert": bson.M{"input": "$visits.visit_time", "to": "date", "onError": nil, "onNull": nil}},
+		}}},
+	}
+
+	timeRange := bson.M{}
+	if !from.IsZero() {
+		timeRange["$gte"] = from
+	}
+	if !to.IsZero() {
+		timeRange["$lt"] = to
+	}
+	if len(timeRange) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"visit_at": timeRange}}})
+	}
+
+	groupKey := interface{}("$visits.store_id")
+
+	if byArea {
+		pipeline = append(pipeline,
+			bson.D{{Key: "$lookup", Value: bson.M{
+				"from":         as.settings.StoresCollection,
+				"localField":   "visits.store_id",
+				"foreignField": "_id",
+				"as":           "store",
+			}}},
+			// prefer the current store master, fall back to the area stored with the visit
+			bson.D{{Key: "$addFields", Value: bson.M{
+				"area_code": bson.M{"$ifNull": bson.A{
+					bson.M{"$arrayElemAt": bson.A{"$store.area_code", 0}},
+					"$visits.area_code",
+					"",
+				}},
+			}}},
+		)
+		groupKey = "$area_code"
+	}
+
+	group := bson.M{
+		"_id":        groupKey,
+		"store_ids":  bson.M{"$addToSet": "$visits.store_id"},
+		"visits":     bson.M{"$sum": 1},
+		"images":     bson.M{"$sum": bson.M{"$size": bson.M{"$ifNull": bson.A{"$visits.image_urls", bson.A{}}}}},
+		"last_visit": bson.M{"$max": "$visit_at"},
+		// the visit that made its job fail
+		"failed_visits": bson.M{"$sum": bson.M{"$cond": bson.A{
+			bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{"$status", "failed"}},
+				bson.M{"$eq": bson.A{"$failed_store_id", "$visits.store_id"}},
+			}},
+			1,
+			0,
+		}}},
+	}
+
+	metrics := bson.M{}
+
+	for name, field := range VisitMetrics {
+		values := bson.M{"$ifNull": bson.A{"$visits." + field, bson.A{}}}
+		sumKey := fmt.Sprintf("metric_%s_sum", name)
+		countKey := fmt.Sprintf("metric_%s_count", name)
+
+		group[sumKey] = bson.M{"$sum": bson.M{"$sum": values}}
+		group[countKey] = bson.M{"$sum": bson.M{"$size": values}}
+
+		metrics[name] = bson.M{
+			"count": "$" + countKey,
+			"avg": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$" + countKey, 0}},
+				bson.M{"$divide": bson.A{"$" + sumKey, "$" + countKey}},
+				0,
+			}},
+		}
+	}
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$project", Value: bson.M{
+			"stores":        bson.M{"$size": "$store_ids"},
+			"visits":        1,
+			"images":        1,
+			"last_visit":    1,
+			"failed_visits": 1,
+			"failure_rate":  bson.M{"$divide": bson.A{"$failed_visits", "$visits"}},
+			"metrics":       metrics,
+		}}},
+		bson.D{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	)
+
+	return pipeline
+}
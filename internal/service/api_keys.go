@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrAPIKeyExists is returned when inserting a key whose hash is already stored
+var ErrAPIKeyExists = errors.New("api key already exists")
+
+// apiKeyPrefix starts every generated key, so that leaked keys are easy to spot
+const apiKeyPrefix = "ijp_"
+
+// NewAPIKey generates a random key and returns it with the record storing it
+func NewAPIKey(owner, name string, admin bool) (string, model.APIKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", model.APIKey{}, err
+	}
+
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+
+	return key, APIKeyRecord(key, owner, name, admin), nil
+}
+
+// APIKeyRecord returns the record storing key, which is not kept itself
+func APIKeyRecord(key, owner, name string, admin bool) model.APIKey {
+	prefix := key
+	if len(prefix) > len(apiKeyPrefix)+6 {
+		prefix = prefix[:len(apiKeyPrefix)+6]
+	}
+
+	return model.APIKey{
+		Owner:     owner,
+		Name:      name,
+		Hash:      HashAPIKey(key),
+		Prefix:    prefix,
+		Admin:     admin,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// HashAPIKey returns the hash a key is stored and looked up by. Generated keys
+// are long and random, so a fast hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type APIKeyService struct {
+	database
+}
+
+// NewAPIKeyService creates a new instance of APIKeyService
+func NewAPIKeyService(client *mongo.Client, settings Settings) *APIKeyService {
+	return &APIKeyService{
+		database: database{client: client, settings: settings},
+	}
+}
+
+// CreateIndexes makes sure the unique index on the key hashes exists
+func (ks *APIKeyService) CreateIndexes(ctx context.Context) (err error) {
+	ctx, end := ks.startOperation(ctx, "CreateIndexes", ks.apiKeysCollection())
+	defer func() { end(err) }()
+
+	collection := ks.apiKeysCollection()
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	return err
+}
+
+// InsertAPIKey stores a new key and returns its ID, ErrAPIKeyExists if its hash is taken
+func (ks *APIKeyService) InsertAPIKey(ctx context.Context, key model.APIKey) (id primitive.ObjectID, err error) {
+	ctx, end := ks.startOperation(ctx, "InsertAPIKey", ks.apiKeysCollection())
+	defer func() { end(err) }()
+
+	collection := ks.apiKeysCollection()
+
+	logger.FromContext(ctx).Debug("Called InsertAPIKey", "owner", key.Owner)
+
+	result, err := collection.InsertOne(ctx, key)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.ObjectID{}, ErrAPIKeyExists
+	}
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// FindAPIKeyByHash returns the key with the given hash, mongo.ErrNoDocuments if there is none
+func (ks *APIKeyService) FindAPIKeyByHash(ctx context.Context, hash string) (key *model.APIKey, err error) {
+	ctx, end := ks.startOperation(ctx, "FindAPIKeyByHash", ks.apiKeysCollection())
+	defer func() { end(err) }()
+
+	collection := ks.apiKeysCollection()
+
+	var k model.APIKey
+	err = collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// ListAPIKeys returns every key, oldest first
+func (ks *APIKeyService) ListAPIKeys(ctx context.Context) (keys []model.APIKey, err error) {
+	ctx, end := ks.startOperation(ctx, "ListAPIKeys", ks.apiKeysCollection())
+	defer func() { end(err) }()
+
+	collection := ks.apiKeysCollection()
+
+	logger.FromContext(ctx).Debug("Called ListAPIKeys")
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	keys = []model.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// UpdateAPIKeyLimits replaces the limits of a key, nil restores the defaults.
+// It returns mongo.ErrNoDocuments if the key does not exist.
+func (ks *APIKeyService) UpdateAPIKeyLimits(ctx context.Context, id primitive.ObjectID, limits *model.Limits) (err error) {
+	ctx, end := ks.startOperation(ctx, "UpdateAPIKeyLimits", ks.apiKeysCollection())
+	defer func() { end(err) }()
+
+	collection := ks.apiKeysCollection()
+
+	logger.FromContext(ctx).Debug("Called UpdateAPIKeyLimits", "key_id", id.Hex())
+
+	update := bson.M{"$unset": bson.M{"limits": ""}}
+	if limits != nil {
+		update = bson.M{"$set": bson.M{"limits": limits}}
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// DeleteAPIKey revokes a key, mongo.ErrNoDocuments if it does not exist
+func (ks *APIKeyService) DeleteAPIKey(ctx context.Context, id primitive.ObjectID) (err error) {
+	ctx, end := ks.startOperation(ctx, "DeleteAPIKey", ks.apiKeysCollection())
+	defer func() { end(err) }()
+
+	collection := ks.apiKeysCollection()
+
+	logger.FromContext(ctx).Debug("Called DeleteAPIKey", "key_id", id.Hex())
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
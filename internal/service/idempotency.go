@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"image-job-processor/internal/logger"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyKeyTTL is how long an Idempotency-Key is remembered
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyPendingTTL is how long a reservation waits for its job. A request
+// dying before storing its job, or failing to, leaves the reservation without
+// one: after this long another request with the key takes it over.
+const IdempotencyPendingTTL = time.Minute
+
+// IdempotencyRecord maps an Idempotency-Key to the request it was first used with
+type IdempotencyRecord struct {
+	Key         string             `bson:"key"`
+	RequestHash string             `bson:"request_hash"`
+	JobID       primitive.ObjectID `bson:"job_id,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+}
+
+type IdempotencyService struct {
+	database
+}
+
+// NewIdempotencyService creates a new instance of IdempotencyService
+func NewIdempotencyService(client *mongo.Client, settings Settings) *IdempotencyService {
+	return &IdempotencyService{
+		database: database{client: client, settings: settings},
+	}
+}
+
+// CreateIndexes makes sure the unique and TTL indexes on the keys exist
+func (is *IdempotencyService) CreateIndexes(ctx context.Context) (err error) {
+	ctx, end := is.startOperation(ctx, "CreateIndexes", is.idempotencyCollection())
+	defer func() { end(err) }()
+
+	collection := is.idempotencyCollection()
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(IdempotencyKeyTTL.Seconds())),
+		},
+	})
+
+	return err
+}
+
+// ReserveKey claims key for a request with the given hash. If the key has already been
+// claimed the existing record is returned instead, otherwise the returned record is nil.
+// A reservation still without a job after IdempotencyPendingTTL is taken over.
+func (is *IdempotencyService) ReserveKey(ctx context.Context, key, requestHash string) (found *IdempotencyRecord, err error) {
+	ctx, end := is.startOperation(ctx, "ReserveKey", is.idempotencyCollection())
+	defer func() { end(err) }()
+
+	collection := is.idempotencyCollection()
+
+	logger.FromContext(ctx).Debug("Called ReserveKey", "idempotency_key", key)
+
+	now := time.Now().UTC()
+
+	// matches only an abandoned reservation, otherwise the upsert inserts a new
+	// one and fails on the unique index if the key is taken
+	filter := bson.M{
+		"key":        key,
+		"job_id":     bson.M{"$exists": false},
+		"created_at": bson.M{"$lt": now.Add(-IdempotencyPendingTTL)},
+	}
+	update := bson.M{"$set": bson.M{"request_hash": requestHash, "created_at": now}}
+
+	_, err = collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err == nil {
+		return nil, nil
+	}
+
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing IdempotencyRecord
+	err = collection.FindOne(ctx, bson.M{"key": key}).Decode(&existing)
+	if err != nil {
+		return nil, err
+	}
+
+	return &existing, nil
+}
+
+// SetJobID stores the job created for the request that reserved key
+func (is *IdempotencyService) SetJobID(ctx context.Context, key string, jobID primitive.ObjectID) (err error) {
+	ctx, end := is.startOperation(ctx, "SetJobID", is.idempotencyCollection())
+	defer func() { end(err) }()
+
+	collection := is.idempotencyCollection()
+
+	logger.FromContext(ctx).Debug("Called SetJobID", "idempotency_key", key, "job_id", jobID.Hex())
+
+	_, err = collection.UpdateOne(ctx, bson.M{"key": key}, bson.M{"$set": bson.M{"job_id": jobID}})
+	return err
+}
+
+// ReleaseKey removes a reservation whose request could not be completed so the client can retry
+func (is *IdempotencyService) ReleaseKey(ctx context.Context, key string) (err error) {
+	ctx, end := is.startOperation(ctx, "ReleaseKey", is.idempotencyCollection())
+	defer func() { end(err) }()
+
+	collection := is.idempotencyCollection()
+
+	logger.FromContext(ctx).Debug("Called ReleaseKey", "idempotency_key", key)
+
+	_, err = collection.DeleteOne(ctx, bson.M{"key": key})
+	return err
+}
@@ -0,0 +1,545 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image-job-processor/internal/model"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MemoryJobRepository keeps the jobs in memory, with the same behavior as
+// StoresVisitService. It lets the API and the job processing run without
+// MongoDB, in tests. Jobs are copied in and out, so callers never share them.
+type MemoryJobRepository struct {
+	mu   sync.Mutex
+	jobs map[primitive.ObjectID]*model.StoresVisit
+}
+
+// NewMemoryJobRepository creates an empty MemoryJobRepository
+func NewMemoryJobRepository() *MemoryJobRepository {
+	return &MemoryJobRepository{
+		jobs: make(map[primitive.ObjectID]*model.StoresVisit),
+	}
+}
+
+// InsertStoresVisit stores a new job and returns its ID, generated unless it is set
+func (m *MemoryJobRepository) InsertStoresVisit(ctx context.Context, storesVisit model.StoresVisit) (primitive.ObjectID, error) {
+	if err := ctx.Err(); err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv := cloneStoresVisit(&storesVisit)
+	if sv.ID.IsZero() {
+		sv.ID = primitive.NewObjectID()
+	}
+	if _, exists := m.jobs[sv.ID]; exists {
+		return primitive.ObjectID{}, fmt.Errorf("job %s already exists", sv.ID.Hex())
+	}
+
+	m.jobs[sv.ID] = sv
+	return sv.ID, nil
+}
+
+// FindStoresVisitByID returns a copy of the job
+func (m *MemoryJobRepository) FindStoresVisitByID(ctx context.Context, id primitive.ObjectID) (*model.StoresVisit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return cloneStoresVisit(sv), nil
+}
+
+// ClaimStoresVisit leases the oldest ongoing job without a lease, or whose
+// lease expired and not held, to owner until the given time and returns a copy
+// of it
+func (m *MemoryJobRepository) ClaimStoresVisit(ctx context.Context, owner string, until time.Time, held []primitive.ObjectID) (*model.StoresVisit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	var oldest *model.StoresVisit
+	for _, sv := range m.jobs {
+		if sv.Status != "ongoing" || !now.After(sv.LeaseExpiresAt) || slices.Contains(held, sv.ID) {
+			continue
+		}
+		if oldest == nil || bytes.Compare(sv.ID[:], oldest.ID[:]) < 0 {
+			oldest = sv
+		}
+	}
+
+	if oldest == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	oldest.LeaseOwner = owner
+	oldest.LeaseExpiresAt = until.UTC()
+
+	return cloneStoresVisit(oldest), nil
+}
+
+// RenewLeases extends the leases owner holds on the given ongoing jobs until
+// the given time
+func (m *MemoryJobRepository) RenewLeases(ctx context.Context, owner string, until time.Time, ids []primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		if sv, ok := m.jobs[id]; ok && sv.Status == "ongoing" && sv.LeaseOwner == owner {
+			sv.LeaseExpiresAt = until.UTC()
+		}
+	}
+
+	return nil
+}
+
+// ReleaseLeases gives up the leases owner holds on the given ongoing jobs, or
+// on all of them when no job is given
+func (m *MemoryJobRepository) ReleaseLeases(ctx context.Context, owner string, ids ...primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, sv := range m.jobs {
+		if sv.Status != "ongoing" || sv.LeaseOwner != owner || (len(ids) > 0 && !slices.Contains(ids, id)) {
+			continue
+		}
+		sv.LeaseOwner = ""
+		sv.LeaseExpiresAt = time.Time{}
+	}
+
+	return nil
+}
+
+// FindStoresVisits returns copies of the jobs matching filter, newest first, without their visits
+func (m *MemoryJobRepository) FindStoresVisits(ctx context.Context, filter JobFilter) ([]model.StoresVisit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := []model.StoresVisit{}
+	for _, sv := range m.jobs {
+		if filter.Owner != "" && sv.Owner != filter.Owner {
+			continue
+		}
+		if filter.Status != "" && sv.Status != filter.Status {
+			continue
+		}
+
+		c := *cloneStoresVisit(sv)
+		c.Visits = nil
+		c.CallbackAttempts = nil
+		c.TraceContext = nil
+		found = append(found, c)
+	}
+
+	slices.SortFunc(found, func(a, b model.StoresVisit) int {
+		return bytes.Compare(b.ID[:], a.ID[:])
+	})
+
+	if filter.Limit > 0 && int64(len(found)) > filter.Limit {
+		found = found[:filter.Limit]
+	}
+
+	return found, nil
+}
+
+// GetOwnerByID returns the owner of the job
+func (m *MemoryJobRepository) GetOwnerByID(ctx context.Context, id primitive.ObjectID) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.find(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	return sv.Owner, nil
+}
+
+// GetSubmissionUsage counts the ongoing jobs submitted with an API key, and the
+// images of the jobs it submitted since the given time
+func (m *MemoryJobRepository) GetSubmissionUsage(ctx context.Context, apiKeyID primitive.ObjectID, since time.Time) (activeJobs, images int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sv := range m.jobs {
+		if sv.APIKeyID != apiKeyID {
+			continue
+		}
+
+		if sv.Status == "ongoing" {
+			activeJobs++
+		}
+
+		// object IDs start with their creation time, to the second
+		if !sv.ID.Timestamp().Before(since.Truncate(time.Second)) {
+			for _, v := range sv.Visits {
+				images += int64(len(v.ImageURLs))
+			}
+		}
+	}
+
+	return activeJobs, images, nil
+}
+
+// GetStatusAndErrorByID returns the status of the job and why it failed, if it did
+func (m *MemoryJobRepository) GetStatusAndErrorByID(ctx context.Context, id primitive.ObjectID) (status, errMssg, failedStoreID string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.find(ctx, id)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return sv.Status, sv.Error, sv.FailedStoreID, nil
+}
+
+// UpdateStoresVisitStatus moves an ongoing job to completed, or to failed with
+// the error message and failed store ID
+func (m *MemoryJobRepository) UpdateStoresVisitStatus(ctx context.Context, id primitive.ObjectID, status, errMssg, failedStoreID string) error {
+	if err := validateStatusUpdate(status, errMssg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.findOngoing(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	sv.Status = status
+	if status == "failed" {
+		sv.Error = errMssg
+		sv.FailedStoreID = failedStoreID
+	}
+
+	return nil
+}
+
+// UpdateVisitInfo updates the perimeters, image UUIDs and store details of a
+// visit of an ongoing job
+func (m *MemoryJobRepository) UpdateVisitInfo(ctx context.Context, id primitive.ObjectID, visitIndex int, newPerimeters []int64, newImageUUIDs []string, st model.Store) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.findOngoing(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if visitIndex < 0 || visitIndex >= len(sv.Visits) {
+		return fmt.Errorf("job %s has no visit %d", id.Hex(), visitIndex)
+	}
+
+	visit := &sv.Visits[visitIndex]
+	visit.Perimeters = slices.Clone(newPerimeters)
+	visit.ImageUUIDs = slices.Clone(newImageUUIDs)
+	visit.StoreName = st.Name
+	visit.AreaCode = st.AreaCode
+
+	return nil
+}
+
+// AppendCallbackAttempt records a webhook delivery attempt on the job
+func (m *MemoryJobRepository) AppendCallbackAttempt(ctx context.Context, id primitive.ObjectID, attempt model.CallbackAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.find(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	sv.CallbackAttempts = append(sv.CallbackAttempts, attempt)
+	return nil
+}
+
+// GetCallbackInfoByID returns the callback URL of the job and the delivery attempts made so far
+func (m *MemoryJobRepository) GetCallbackInfoByID(ctx context.Context, id primitive.ObjectID) (string, []model.CallbackAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, err := m.find(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return sv.CallbackURL, slices.Clone(sv.CallbackAttempts), nil
+}
+
+// Ping always succeeds
+func (m *MemoryJobRepository) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// find returns the stored job, m.mu must be held
+func (m *MemoryJobRepository) find(ctx context.Context, id primitive.ObjectID) (*model.StoresVisit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sv, ok := m.jobs[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return sv, nil
+}
+
+// findOngoing returns the stored job if it is ongoing, m.mu must be held
+func (m *MemoryJobRepository) findOngoing(ctx context.Context, id primitive.ObjectID) (*model.StoresVisit, error) {
+	sv, err := m.find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if sv.Status != "ongoing" {
+		return nil, ErrJobNotOngoing
+	}
+
+	return sv, nil
+}
+
+func cloneStoresVisit(sv *model.StoresVisit) *model.StoresVisit {
+	c := *sv
+
+	c.Visits = slices.Clone(sv.Visits)
+	for i, v := range c.Visits {
+		c.Visits[i].ImageURLs = slices.Clone(v.ImageURLs)
+		c.Visits[i].ImageUUIDs = slices.Clone(v.ImageUUIDs)
+		c.Visits[i].Perimeters = slices.Clone(v.Perimeters)
+	}
+	c.CallbackAttempts = slices.Clone(sv.CallbackAttempts)
+	c.TraceContext = maps.Clone(sv.TraceContext)
+
+	return &c
+}
+
+// MemoryIdempotencyRepository keeps the Idempotency-Key records in memory,
+// with the same behavior as IdempotencyService, including the expiry after
+// IdempotencyKeyTTL
+type MemoryIdempotencyRepository struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+// NewMemoryIdempotencyRepository creates an empty MemoryIdempotencyRepository
+func NewMemoryIdempotencyRepository() *MemoryIdempotencyRepository {
+	return &MemoryIdempotencyRepository{
+		records: make(map[string]IdempotencyRecord),
+	}
+}
+
+// ReserveKey claims key for a request with the given hash. If the key has already been
+// claimed the existing record is returned instead, otherwise the returned record is nil.
+// A reservation still without a job after IdempotencyPendingTTL is taken over.
+func (m *MemoryIdempotencyRepository) ReserveKey(ctx context.Context, key, requestHash string) (*IdempotencyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.records[key]; ok {
+		ttl := IdempotencyKeyTTL
+		if existing.JobID.IsZero() {
+			ttl = IdempotencyPendingTTL
+		}
+		if time.Since(existing.CreatedAt) < ttl {
+			return &existing, nil
+		}
+	}
+
+	m.records[key] = IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	return nil, nil
+}
+
+// SetJobID stores the job created for the request that reserved key
+func (m *MemoryIdempotencyRepository) SetJobID(ctx context.Context, key string, jobID primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if record, ok := m.records[key]; ok {
+		record.JobID = jobID
+		m.records[key] = record
+	}
+
+	return nil
+}
+
+// ReleaseKey removes a reservation whose request could not be completed so the client can retry
+func (m *MemoryIdempotencyRepository) ReleaseKey(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	return nil
+}
+
+// MemoryAPIKeyRepository keeps the API keys in memory, with the same behavior
+// as APIKeyService
+type MemoryAPIKeyRepository struct {
+	mu   sync.Mutex
+	keys map[primitive.ObjectID]model.APIKey
+}
+
+// NewMemoryAPIKeyRepository creates an empty MemoryAPIKeyRepository
+func NewMemoryAPIKeyRepository() *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{
+		keys: make(map[primitive.ObjectID]model.APIKey),
+	}
+}
+
+// InsertAPIKey stores a new key and returns its ID, ErrAPIKeyExists if its hash is taken
+func (m *MemoryAPIKeyRepository) InsertAPIKey(ctx context.Context, key model.APIKey) (primitive.ObjectID, error) {
+	if err := ctx.Err(); err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.keys {
+		if k.Hash == key.Hash {
+			return primitive.ObjectID{}, ErrAPIKeyExists
+		}
+	}
+
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	m.keys[key.ID] = key
+
+	return key.ID, nil
+}
+
+// FindAPIKeyByHash returns the key with the given hash, mongo.ErrNoDocuments if there is none
+func (m *MemoryAPIKeyRepository) FindAPIKeyByHash(ctx context.Context, hash string) (*model.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.keys {
+		if k.Hash == hash {
+			return &k, nil
+		}
+	}
+
+	return nil, mongo.ErrNoDocuments
+}
+
+// ListAPIKeys returns every key, oldest first
+func (m *MemoryAPIKeyRepository) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]model.APIKey, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k)
+	}
+
+	slices.SortFunc(keys, func(a, b model.APIKey) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+
+	return keys, nil
+}
+
+// UpdateAPIKeyLimits replaces the limits of a key, nil restores the defaults.
+// It returns mongo.ErrNoDocuments if the key does not exist.
+func (m *MemoryAPIKeyRepository) UpdateAPIKeyLimits(ctx context.Context, id primitive.ObjectID, limits *model.Limits) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[id]
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	if limits != nil {
+		l := *limits
+		limits = &l
+	}
+	key.Limits = limits
+	m.keys[id] = key
+
+	return nil
+}
+
+// DeleteAPIKey revokes a key, mongo.ErrNoDocuments if it does not exist
+func (m *MemoryAPIKeyRepository) DeleteAPIKey(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[id]; !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	delete(m.keys, id)
+	return nil
+}
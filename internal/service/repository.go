@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image-job-processor/internal/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrJobNotOngoing is returned when a job that already reached a terminal
+// state is updated
+var ErrJobNotOngoing = errors.New("job is not ongoing")
+
+// JobRepository stores the jobs. StoresVisitService keeps them in MongoDB,
+// MemoryJobRepository in memory.
+//
+// Methods return mongo.ErrNoDocuments when the job does not exist. Status and
+// visit updates only apply to ongoing jobs, atomically: once a job is completed
+// or failed every later update returns ErrJobNotOngoing.
+type JobRepository interface {
+	InsertStoresVisit(ctx context.Context, storesVisit model.StoresVisit) (primitive.ObjectID, error)
+	FindStoresVisitByID(ctx context.Context, id primitive.ObjectID) (*model.StoresVisit, error)
+	// ClaimStoresVisit leases the oldest ongoing job without a lease, or whose
+	// lease expired, to owner until the given time. The held jobs, queued or
+	// running at owner, are left alone even if their lease expired. It returns
+	// mongo.ErrNoDocuments when there is no job to claim.
+	ClaimStoresVisit(ctx context.Context, owner string, until time.Time, held []primitive.ObjectID) (*model.StoresVisit, error)
+	// RenewLeases extends the leases owner holds on the given ongoing jobs
+	// until the given time
+	RenewLeases(ctx context.Context, owner string, until time.Time, ids []primitive.ObjectID) error
+	// ReleaseLeases gives up the leases owner holds on the given ongoing jobs,
+	// or on all of them when no job is given, so other instances can claim
+	// them right away
+	ReleaseLeases(ctx context.Context, owner string, ids ...primitive.ObjectID) error
+	// FindStoresVisits returns the jobs matching filter, newest first, without their visits
+	FindStoresVisits(ctx context.Context, filter JobFilter) ([]model.StoresVisit, error)
+	GetOwnerByID(ctx context.Context, id primitive.ObjectID) (string, error)
+	// GetSubmissionUsage counts the ongoing jobs submitted with an API key, and
+	// the images of the jobs it submitted since the given time
+	GetSubmissionUsage(ctx context.Context, apiKeyID primitive.ObjectID, since time.Time) (activeJobs, images int64, err error)
+	GetStatusAndErrorByID(ctx context.Context, id primitive.ObjectID) (status, errMssg, failedStoreID string, err error)
+	UpdateStoresVisitStatus(ctx context.Context, id primitive.ObjectID, status, errMssg, failedStoreID string) error
+	UpdateVisitInfo(ctx context.Context, id primitive.ObjectID, visitIndex int, newPerimeters []int64, newImageUUIDs []string, st model.Store) error
+	AppendCallbackAttempt(ctx context.Context, id primitive.ObjectID, attempt model.CallbackAttempt) error
+	GetCallbackInfoByID(ctx context.Context, id primitive.ObjectID) (callbackURL string, attempts []model.CallbackAttempt, err error)
+	// Ping checks that the jobs can be read and written
+	Ping(ctx context.Context) error
+}
+
+// IdempotencyRepository remembers the Idempotency-Key of submissions.
+// IdempotencyService keeps them in MongoDB, MemoryIdempotencyRepository in memory.
+type IdempotencyRepository interface {
+	// ReserveKey claims key for a request with the given hash. If the key has already been
+	// claimed the existing record is returned instead, otherwise the returned record is nil.
+	// A reservation still without a job after IdempotencyPendingTTL is taken over.
+	ReserveKey(ctx context.Context, key, requestHash string) (*IdempotencyRecord, error)
+	// SetJobID stores the job created for the request that reserved key
+	SetJobID(ctx context.Context, key string, jobID primitive.ObjectID) error
+	// ReleaseKey removes a reservation whose request could not be completed so the client can retry
+	ReleaseKey(ctx context.Context, key string) error
+}
+
+// JobFilter selects the jobs listed by FindStoresVisits. Empty fields match
+// every job, a Limit of 0 returns them all.
+type JobFilter struct {
+	Owner  string
+	Status string
+	Limit  int64
+}
+
+// APIKeyRepository stores the API keys. APIKeyService keeps them in MongoDB,
+// MemoryAPIKeyRepository in memory.
+type APIKeyRepository interface {
+	// InsertAPIKey stores a new key and returns its ID, ErrAPIKeyExists if its hash is taken
+	InsertAPIKey(ctx context.Context, key model.APIKey) (primitive.ObjectID, error)
+	// FindAPIKeyByHash returns the key with the given hash, mongo.ErrNoDocuments if there is none
+	FindAPIKeyByHash(ctx context.Context, hash string) (*model.APIKey, error)
+	// ListAPIKeys returns every key, oldest first
+	ListAPIKeys(ctx context.Context) ([]model.APIKey, error)
+	// UpdateAPIKeyLimits replaces the limits of a key, nil restores the
+	// defaults. It returns mongo.ErrNoDocuments if the key does not exist.
+	UpdateAPIKeyLimits(ctx context.Context, id primitive.ObjectID, limits *model.Limits) error
+	// DeleteAPIKey revokes a key, mongo.ErrNoDocuments if it does not exist
+	DeleteAPIKey(ctx context.Context, id primitive.ObjectID) error
+}
+
+var (
+	_ JobRepository         = (*StoresVisitService)(nil)
+	_ JobRepository         = (*MemoryJobRepository)(nil)
+	_ IdempotencyRepository = (*IdempotencyService)(nil)
+	_ IdempotencyRepository = (*MemoryIdempotencyRepository)(nil)
+	_ APIKeyRepository      = (*APIKeyService)(nil)
+	_ APIKeyRepository      = (*MemoryAPIKeyRepository)(nil)
+)
+
+// validateStatusUpdate checks that a job can be moved to status, the
+// repositories only move ongoing jobs to completed or failed
+func validateStatusUpdate(status, errMssg string) error {
+	switch status {
+	case "completed":
+		return nil
+	case "failed":
+		// failed_store_id is empty when the failure is not caused by a single store
+		if errMssg == "" {
+			return errors.New("error message missing")
+		}
+		return nil
+	default:
+		return fmt.Errorf("can not move a job to status %q", status)
+	}
+}
@@ -4,56 +4,104 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"image-job-processor/internal/db"
 	"image-job-processor/internal/logger"
+	"image-job-processor/internal/metrics"
 	"image-job-processor/internal/model"
+	"image-job-processor/internal/tracing"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const db_name string = "image-job-processor"
-const collection_name string = "stores_visits"
+// Settings names the database and the collections used by the services
+type Settings struct {
+	Database              string
+	JobsCollection        string
+	StoresCollection      string
+	IdempotencyCollection string
+	APIKeysCollection     string
+	// MigrationsCollection records the data migrations already applied
+	MigrationsCollection string
+	// OperationTimeout bounds every call to MongoDB, on top of the deadline of
+	// the caller's context
+	OperationTimeout time.Duration
+}
+
+// database is shared by the services, it gives them their collections and
+// bounds their calls
+type database struct {
+	client   *mongo.Client
+	settings Settings
+}
+
+func (d database) jobsCollection() *mongo.Collection {
+	return d.client.Database(d.settings.Database).Collection(d.settings.JobsCollection)
+}
+
+func (d database) storesCollection() *mongo.Collection {
+	return d.client.Database(d.settings.Database).Collection(d.settings.StoresCollection)
+}
+
+func (d database) idempotencyCollection() *mongo.Collection {
+	return d.client.Database(d.settings.Database).Collection(d.settings.IdempotencyCollection)
+}
+
+func (d database) apiKeysCollection() *mongo.Collection {
+	return d.client.Database(d.settings.Database).Collection(d.settings.APIKeysCollection)
+}
+
+func (d database) migrationsCollection() *mongo.Collection {
+	return d.client.Database(d.settings.Database).Collection(d.settings.MigrationsCollection)
+}
 
 type StoresVisitService struct {
-	client *mongo.Client
+	database
 }
 
 // NewStoresVisitService creates a new instance of StoresVisitService
-func NewStoresVisitService() *StoresVisitService {
+func NewStoresVisitService(client *mongo.Client, settings Settings) *StoresVisitService {
 	return &StoresVisitService{
-		client: db.GetMongoClient(),
+		database: database{client: client, settings: settings},
 	}
 }
 
 // InsertStoresVisit inserts a new StoresVisit into the database and returns its ID
-func (svs *StoresVisitService) InsertStoresVisit(storesVisit model.StoresVisit) (primitive.ObjectID, error) {
-	collection := svs.client.Database(db_name).Collection(collection_name)
+func (svs *StoresVisitService) InsertStoresVisit(ctx context.Context, storesVisit model.StoresVisit) (id primitive.ObjectID, err error) {
+	ctx, end := svs.startOperation(ctx, "InsertStoresVisit", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
 
 	// Insert the document and get the result
-	result, err := collection.InsertOne(context.TODO(), storesVisit)
+	result, err := collection.InsertOne(ctx, storesVisit)
 	if err != nil {
 		return primitive.ObjectID{}, err // Return an empty ObjectID and the error
 	}
 
 	// Return the inserted ID
-	logger.GetLogger().Log(fmt.Sprintf("Inserted new id %v", result.InsertedID.(primitive.ObjectID).Hex()))
+	logger.FromContext(ctx).Debug("Inserted new job", "job_id", result.InsertedID.(primitive.ObjectID).Hex())
 	return result.InsertedID.(primitive.ObjectID), nil
 }
 
 // FindStoresVisitByID fetches a StoresVisit by its ID from the database
-func (svs *StoresVisitService) FindStoresVisitByID(id primitive.ObjectID) (*model.StoresVisit, error) {
-	collection := svs.client.Database(db_name).Collection(collection_name)
+func (svs *StoresVisitService) FindStoresVisitByID(ctx context.Context, id primitive.ObjectID) (sv *model.StoresVisit, err error) {
+	ctx, end := svs.startOperation(ctx, "FindStoresVisitByID", svs.jobsCollection())
+	defer func() { end(err) }()
 
-	logger.GetLogger().Log(fmt.Sprintf("Called FindStoresVisitByID: %v", id.Hex()))
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called FindStoresVisitByID", "job_id", id.Hex())
 
 	var storesVisit model.StoresVisit
 	filter := bson.M{"_id": id}
 
 	// Find the document by ID
-	err := collection.FindOne(context.TODO(), filter).Decode(&storesVisit)
+	err = collection.FindOne(ctx, filter).Decode(&storesVisit)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, mongo.ErrNoDocuments
@@ -64,11 +112,78 @@ func (svs *StoresVisitService) FindStoresVisitByID(id primitive.ObjectID) (*mode
 	return &storesVisit, nil
 }
 
+// ClaimStoresVisit leases the oldest ongoing job without a lease, or whose
+// lease expired and not held, to owner until the given time. The job is found
+// and leased in a single operation, so two instances never claim the same job.
+func (svs *StoresVisitService) ClaimStoresVisit(ctx context.Context, owner string, until time.Time, held []primitive.ObjectID) (sv *model.StoresVisit, err error) {
+	ctx, end := svs.startOperation(ctx, "ClaimStoresVisit", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	// $nin rejects a null array
+	if held == nil {
+		held = []primitive.ObjectID{}
+	}
+
+	filter := bson.M{
+		"status":           "ongoing",
+		"_id":              bson.M{"$nin": held},
+		"lease_expires_at": bson.M{"$not": bson.M{"$gte": time.Now().UTC()}},
+	}
+	update := bson.M{"$set": bson.M{"lease_owner": owner, "lease_expires_at": until.UTC()}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"_id": 1}).SetReturnDocument(options.After)
+
+	var storesVisit model.StoresVisit
+	err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&storesVisit)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.FromContext(ctx).Debug("Claimed job", "job_id", storesVisit.ID.Hex())
+	return &storesVisit, nil
+}
+
+// RenewLeases extends the leases owner holds on the given ongoing jobs until
+// the given time
+func (svs *StoresVisitService) RenewLeases(ctx context.Context, owner string, until time.Time, ids []primitive.ObjectID) (err error) {
+	ctx, end := svs.startOperation(ctx, "RenewLeases", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "status": "ongoing", "lease_owner": owner},
+		bson.M{"$set": bson.M{"lease_expires_at": until.UTC()}},
+	)
+	return err
+}
+
+// ReleaseLeases gives up the leases owner holds on the given ongoing jobs, or
+// on all of them when no job is given
+func (svs *StoresVisitService) ReleaseLeases(ctx context.Context, owner string, ids ...primitive.ObjectID) (err error) {
+	ctx, end := svs.startOperation(ctx, "ReleaseLeases", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	filter := bson.M{"status": "ongoing", "lease_owner": owner}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+
+	_, err = collection.UpdateMany(ctx, filter, bson.M{"$unset": bson.M{"lease_owner": "", "lease_expires_at": ""}})
+	return err
+}
+
 // GetStatusAndErrorByID fetches the status and error message for a StoresVisit by its ID
-func (svs *StoresVisitService) GetStatusAndErrorByID(id primitive.ObjectID) (string, string, string, error) {
-	collection := svs.client.Database(db_name).Collection(collection_name)
+func (svs *StoresVisitService) GetStatusAndErrorByID(ctx context.Context, id primitive.ObjectID) (status, errMssg, failedStoreID string, err error) {
+	ctx, end := svs.startOperation(ctx, "GetStatusAndErrorByID", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
 
-	logger.GetLogger().Log(fmt.Sprintf("Called GetStatusAndErrorByID: %v", id.Hex()))
+	logger.FromContext(ctx).Debug("Called GetStatusAndErrorByID", "job_id", id.Hex())
 
 	// Create a variable to hold the result
 	result := struct {
@@ -81,7 +196,7 @@ func (svs *StoresVisitService) GetStatusAndErrorByID(id primitive.ObjectID) (str
 	projection := bson.M{"status": 1, "error": 1, "failed_store_id": 1} // fields to include
 
 	// Find the document by ID with projection
-	err := collection.FindOne(context.TODO(), filter, options.FindOne().SetProjection(projection)).Decode(&result)
+	err = collection.FindOne(ctx, filter, options.FindOne().SetProjection(projection)).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return "", "", "", mongo.ErrNoDocuments // No document found
@@ -93,64 +208,283 @@ func (svs *StoresVisitService) GetStatusAndErrorByID(id primitive.ObjectID) (str
 	return result.Status, result.Error, result.FailedStoreID, nil
 }
 
-// UpdateStoresVisit updates the status, error message, and failed store ID based on the provided parameters
-func (svs *StoresVisitService) UpdateStoresVisitStatus(id primitive.ObjectID, status, errMssg, failedStoreID string) error {
-	collection := svs.client.Database(db_name).Collection(collection_name)
+// FindStoresVisits fetches the jobs matching filter, newest first, without their visits
+func (svs *StoresVisitService) FindStoresVisits(ctx context.Context, filter JobFilter) (storesVisits []model.StoresVisit, err error) {
+	ctx, end := svs.startOperation(ctx, "FindStoresVisits", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called FindStoresVisits", "owner", filter.Owner, "status", filter.Status)
+
+	query := bson.M{}
+	if filter.Owner != "" {
+		query["owner"] = filter.Owner
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"_id": -1}).
+		SetProjection(bson.M{"visits": 0, "callback_attempts": 0, "trace_context": 0})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	storesVisits = []model.StoresVisit{}
+	if err := cursor.All(ctx, &storesVisits); err != nil {
+		return nil, err
+	}
+
+	return storesVisits, nil
+}
+
+// GetOwnerByID fetches the owner of a StoresVisit, empty if it was submitted without authentication
+func (svs *StoresVisitService) GetOwnerByID(ctx context.Context, id primitive.ObjectID) (owner string, err error) {
+	ctx, end := svs.startOperation(ctx, "GetOwnerByID", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
 
-	logger.GetLogger().Log(fmt.Sprintf("Called UpdateStoresVisitStatus: %v", id.Hex()))
+	logger.FromContext(ctx).Debug("Called GetOwnerByID", "job_id", id.Hex())
 
-	update := bson.M{"$set": bson.M{"status": status}} // Initialize update with status
+	result := struct {
+		Owner string `bson:"owner"`
+	}{}
+
+	err = collection.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"owner": 1})).Decode(&result)
+	if err != nil {
+		return "", err
+	}
 
-	// Check the status and update accordingly
-	if status == "completed" {
-		// If status is "completed", we only update the status
-		update = bson.M{"$set": bson.M{"status": status}}
-	} else if status == "failed" {
+	return result.Owner, nil
+}
 
-		if errMssg == "" || failedStoreID == "" {
-			return errors.New("error message and failed_store_id missing")
-		} else {
-			// If status is "failed", update status, error message, and failed store ID
-			update = bson.M{
-				"$set": bson.M{
-					"status":          status,
-					"error":           errMssg,
-					"failed_store_id": failedStoreID,
+// GetSubmissionUsage counts the ongoing jobs submitted with an API key, and the
+// images of the jobs it submitted since the given time
+func (svs *StoresVisitService) GetSubmissionUsage(ctx context.Context, apiKeyID primitive.ObjectID, since time.Time) (activeJobs, images int64, err error) {
+	ctx, end := svs.startOperation(ctx, "GetSubmissionUsage", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called GetSubmissionUsage", "key_id", apiKeyID.Hex())
+
+	// object IDs start with their creation time
+	sinceID := primitive.NewObjectIDFromTimestamp(since)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"api_key_id": apiKeyID,
+			"$or": bson.A{
+				bson.M{"status": "ongoing"},
+				bson.M{"_id": bson.M{"$gte": sinceID}},
+			},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": nil,
+			"active_jobs": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$status", "ongoing"}}, 1, 0},
+			}},
+			"images": bson.M{"$sum": bson.M{
+				"$cond": bson.A{
+					bson.M{"$gte": bson.A{"$_id", sinceID}},
+					bson.M{"$sum": bson.M{"$map": bson.M{
+						"input": "$visits",
+						"in":    bson.M{"$size": "$$this.image_urls"},
+					}}},
+					0,
 				},
-			}
+			}},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var results []struct {
+		ActiveJobs int64 `bson:"active_jobs"`
+		Images     int64 `bson:"images"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return 0, 0, err
+	}
+
+	// no document matched
+	if len(results) == 0 {
+		return 0, 0, nil
+	}
+
+	return results[0].ActiveJobs, results[0].Images, nil
+}
+
+// UpdateStoresVisitStatus moves an ongoing job to completed, or to failed with
+// the error message and failed store ID
+func (svs *StoresVisitService) UpdateStoresVisitStatus(ctx context.Context, id primitive.ObjectID, status, errMssg, failedStoreID string) (err error) {
+	ctx, end := svs.startOperation(ctx, "UpdateStoresVisitStatus", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called UpdateStoresVisitStatus", "job_id", id.Hex())
+
+	if err := validateStatusUpdate(status, errMssg); err != nil {
+		return err
+	}
+
+	update := bson.M{"$set": bson.M{"status": status}}
+	if status == "failed" {
+		update = bson.M{
+			"$set": bson.M{
+				"status":          status,
+				"error":           errMssg,
+				"failed_store_id": failedStoreID,
+			},
 		}
+	}
 
-	} else {
-		return mongo.ErrNoDocuments // Return an error if the status is neither "completed" nor "failed"
+	// matching on the status makes the transition atomic, a job is finished once
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id, "status": "ongoing"}, update)
+	if err != nil {
+		return err
 	}
 
-	// Perform the update operation
-	_, err := collection.UpdateOne(context.TODO(), bson.M{"_id": id}, update)
-	return err
+	return svs.checkMatched(ctx, id, result)
 }
 
-// UpdateVisitInfo updates the perimeters and imageUUIDs of a specific VisitInfo in a StoresVisit document.
-func (svs *StoresVisitService) UpdateVisitInfo(id primitive.ObjectID, visitIndex int, newPerimeters []int64, newImageUUIDs []string) error {
-	collection := svs.client.Database(db_name).Collection(collection_name)
+// UpdateVisitInfo updates the perimeters, imageUUIDs and store details of a specific VisitInfo
+// in a StoresVisit document, as long as the job is ongoing.
+func (svs *StoresVisitService) UpdateVisitInfo(ctx context.Context, id primitive.ObjectID, visitIndex int, newPerimeters []int64, newImageUUIDs []string, st model.Store) (err error) {
+	ctx, end := svs.startOperation(ctx, "UpdateVisitInfo", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
 
-	logger.GetLogger().Log(fmt.Sprintf("Called UpdateVisitInfo: %v", id.Hex()))
+	logger.FromContext(ctx).Debug("Called UpdateVisitInfo", "job_id", id.Hex())
 
 	// Create the filter to find the specific StoresVisit document by ID
-	filter := bson.M{"_id": id}
+	filter := bson.M{"_id": id, "status": "ongoing"}
 
-	// Create the update to set the new perimeters and imageUUIDs
+	// Create the update to set the new perimeters, imageUUIDs and store details
 	update := bson.M{
 		"$set": bson.M{
 			fmt.Sprintf("visits.%d.perimeters", visitIndex):  newPerimeters,
 			fmt.Sprintf("visits.%d.image_uuids", visitIndex): newImageUUIDs,
+			fmt.Sprintf("visits.%d.store_name", visitIndex):  st.Name,
+			fmt.Sprintf("visits.%d.area_code", visitIndex):   st.AreaCode,
 		},
 	}
 
 	// Perform the update operation
-	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	return svs.checkMatched(ctx, id, result)
+}
+
+// checkMatched tells why an update of an ongoing job matched nothing
+func (svs *StoresVisitService) checkMatched(ctx context.Context, id primitive.ObjectID, result *mongo.UpdateResult) error {
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	collection := svs.jobsCollection()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": id})
 	if err != nil {
 		return err
 	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return ErrJobNotOngoing
+}
+
+// AppendCallbackAttempt records a webhook delivery attempt on a StoresVisit document
+func (svs *StoresVisitService) AppendCallbackAttempt(ctx context.Context, id primitive.ObjectID, attempt model.CallbackAttempt) (err error) {
+	ctx, end := svs.startOperation(ctx, "AppendCallbackAttempt", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called AppendCallbackAttempt", "job_id", id.Hex())
+
+	update := bson.M{"$push": bson.M{"callback_attempts": attempt}}
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+// GetCallbackInfoByID fetches the callback URL and the delivery attempts made so far for a StoresVisit
+func (svs *StoresVisitService) GetCallbackInfoByID(ctx context.Context, id primitive.ObjectID) (callbackURL string, attempts []model.CallbackAttempt, err error) {
+	ctx, end := svs.startOperation(ctx, "GetCallbackInfoByID", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called GetCallbackInfoByID", "job_id", id.Hex())
+
+	result := struct {
+		CallbackURL      string                  `bson:"callback_url"`
+		CallbackAttempts []model.CallbackAttempt `bson:"callback_attempts"`
+	}{}
+
+	filter := bson.M{"_id": id}
+	projection := bson.M{"callback_url": 1, "callback_attempts": 1}
+
+	err = collection.FindOne(ctx, filter, options.FindOne().SetProjection(projection)).Decode(&result)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return result.CallbackURL, result.CallbackAttempts, nil
+}
+
+// Ping checks that MongoDB answers
+func (svs *StoresVisitService) Ping(ctx context.Context) (err error) {
+	ctx, end := svs.startOperation(ctx, "Ping", svs.jobsCollection())
+	defer func() { end(err) }()
 
-	return nil
+	return svs.client.Ping(ctx, nil)
+}
+
+// startOperation bounds a service call by the OperationTimeout setting and
+// starts its span and duration metric. The returned function ends them and must
+// be deferred with the error of the call.
+func (d database) startOperation(ctx context.Context, operation string, collection *mongo.Collection) (context.Context, func(error)) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, d.settings.OperationTimeout)
+
+	ctx, span := tracing.Start(ctx, "mongo."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMongoDB,
+			semconv.DBNamespace(collection.Database().Name()),
+			semconv.DBCollectionName(collection.Name()),
+			semconv.DBOperationName(operation),
+		),
+	)
+
+	return ctx, func(err error) {
+		cancel()
+		metrics.ObserveMongo(operation, start)
+
+		// a missing document is an answer, not a failure of the call
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			err = nil
+		}
+		tracing.End(span, err)
+	}
 }
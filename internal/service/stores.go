@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrStoreExists is returned when inserting a store whose ID is already taken
+var ErrStoreExists = errors.New("store already exists")
+
+type StoresService struct {
+	database
+}
+
+// NewStoresService creates a new instance of StoresService
+func NewStoresService(client *mongo.Client, settings Settings) *StoresService {
+	return &StoresService{
+		database: database{client: client, settings: settings},
+	}
+}
+
+// InsertStore inserts a new store into the database
+func (ss *StoresService) InsertStore(ctx context.Context, st model.Store) (err error) {
+	ctx, end := ss.startOperation(ctx, "InsertStore", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	logger.FromContext(ctx).Debug("Called InsertStore", "store_id", st.ID)
+
+	_, err = collection.InsertOne(ctx, st)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrStoreExists
+	}
+	return err
+}
+
+// FindStoreByID fetches a store by its ID
+func (ss *StoresService) FindStoreByID(ctx context.Context, id string) (store *model.Store, err error) {
+	ctx, end := ss.startOperation(ctx, "FindStoreByID", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	logger.FromContext(ctx).Debug("Called FindStoreByID", "store_id", id)
+
+	var st model.Store
+	err = collection.FindOne(ctx, bson.M{"_id": id}).Decode(&st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+// ListStores fetches every store sorted by ID
+func (ss *StoresService) ListStores(ctx context.Context) (stores []model.Store, err error) {
+	ctx, end := ss.startOperation(ctx, "ListStores", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	logger.FromContext(ctx).Debug("Called ListStores")
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	stores = []model.Store{}
+	if err := cursor.All(ctx, &stores); err != nil {
+		return nil, err
+	}
+
+	return stores, nil
+}
+
+// CountStores returns the number of stores in the database
+func (ss *StoresService) CountStores(ctx context.Context) (count int64, err error) {
+	ctx, end := ss.startOperation(ctx, "CountStores", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	return collection.CountDocuments(ctx, bson.M{})
+}
+
+// UpdateStore replaces an existing store, returns mongo.ErrNoDocuments if it does not exist
+func (ss *StoresService) UpdateStore(ctx context.Context, st model.Store) (err error) {
+	ctx, end := ss.startOperation(ctx, "UpdateStore", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	logger.FromContext(ctx).Debug("Called UpdateStore", "store_id", st.ID)
+
+	result, err := collection.ReplaceOne(ctx, bson.M{"_id": st.ID}, st)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// DeleteStore removes a store, returns mongo.ErrNoDocuments if it does not exist
+func (ss *StoresService) DeleteStore(ctx context.Context, id string) (err error) {
+	ctx, end := ss.startOperation(ctx, "DeleteStore", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	logger.FromContext(ctx).Debug("Called DeleteStore", "store_id", id)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// UpsertStores inserts or replaces stores in bulk and returns the number of inserted and updated stores
+func (ss *StoresService) UpsertStores(ctx context.Context, stores []model.Store) (inserted, updated int64, err error) {
+	ctx, end := ss.startOperation(ctx, "UpsertStores", ss.storesCollection())
+	defer func() { end(err) }()
+
+	collection := ss.storesCollection()
+
+	logger.FromContext(ctx).Debug("Called UpsertStores", "stores", len(stores))
+
+	if len(stores) == 0 {
+		return 0, 0, nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(stores))
+	for _, st := range stores {
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": st.ID}).
+			SetReplacement(st).
+			SetUpsert(true))
+	}
+
+	result, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return result.UpsertedCount, result.ModifiedCount, nil
+}
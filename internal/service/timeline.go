@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"image-job-processor/internal/logger"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StoreVisit is a single visit of a store, together with the job it was submitted in
+type StoreVisit struct {
+	JobID      primitive.ObjectID `bson:"job_id"`
+	JobStatus  string             `bson:"job_status"`
+	VisitTime  time.Time          `bson:"visit_time"`
+	ImageURLs  []string           `bson:"image_urls"`
+	ImageUUIDs []string           `bson:"image_uuids"`
+	Perimeters []int64            `bson:"perimeters"`
+}
+
+// CreateIndexes makes sure visits can be looked up by store, jobs listed by
+// owner and counted by API key, and ongoing jobs found by lease
+func (svs *StoresVisitService) CreateIndexes(ctx context.Context) (err error) {
+	ctx, end := svs.startOperation(ctx, "CreateIndexes", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "visits.store_id", Value: 1}, {Key: "visits.visit_time", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "api_key_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "lease_owner", Value: 1}}},
+	})
+
+	return err
+}
+
+// visitTimesMigration names the conversion of visit_time in the migrations collection
+const visitTimesMigration = "visit_times"
+
+// MigrateVisitTimes converts visit_time values stored as strings by older versions
+// into dates, once: it is recorded in the migrations collection and skipped from
+// then on. Every string is kept in visit_time_raw, values that are not valid
+// timestamps are cleared from visit_time and counted in invalid.
+func (svs *StoresVisitService) MigrateVisitTimes(ctx context.Context) (migrated, invalid int64, err error) {
+	ctx, end := svs.startOperation(ctx, "MigrateVisitTimes", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+	migrations := svs.migrationsCollection()
+
+	logger.FromContext(ctx).Debug("Called MigrateVisitTimes")
+
+	err = migrations.FindOne(ctx, bson.M{"_id": visitTimesMigration}).Err()
+	if err == nil {
+		return 0, 0, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, 0, err
+	}
+
+	filter := bson.M{"visits.visit_time": bson.M{"$type": "string"}}
+
+	isString := bson.M{"$eq": bson.A{bson.M{"$type": "$$this.visit_time"}, "string"}}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"visits": bson.M{"$map": bson.M{
+				"input": "$visits",
+				"in": bson.M{"$cond": bson.A{
+					isString,
+					bson.M{"$mergeObjects": bson.A{
+						"$$this",
+						bson.M{
+							"visit_time_raw": "$$this.visit_time",
+							"visit_time": bson.M{"$convert": bson.M{
+								"input":   "$$this.visit_time",
+								"to":      "date",
+								"onError": nil,
+								"onNull":  nil,
+							}},
+						},
+					}},
+					"$$this",
+				}},
+			}},
+		}}},
+	}
+
+	result, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	invalid, err = collection.CountDocuments(ctx, bson.M{"visits": bson.M{"$elemMatch": bson.M{
+		"visit_time":     nil,
+		"visit_time_raw": bson.M{"$exists": true},
+	}}})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = migrations.InsertOne(ctx, bson.M{"_id": visitTimesMigration, "applied_at": time.Now().UTC()})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return 0, 0, err
+	}
+
+	return result.ModifiedCount, invalid, nil
+}
+
+// FindVisitsByStoreID returns every visit of a store across all jobs, ordered by
+// visit time, with a visit time in [from, to). A zero from or to leaves that side
+// of the range open. At most limit visits are returned.
+func (svs *StoresVisitService) FindVisitsByStoreID(ctx context.Context, storeID string, from, to time.Time, limit int64) (visits []StoreVisit, err error) {
+	ctx, end := svs.startOperation(ctx, "FindVisitsByStoreID", svs.jobsCollection())
+	defer func() { end(err) }()
+
+	collection := svs.jobsCollection()
+
+	logger.FromContext(ctx).Debug("Called FindVisitsByStoreID", "store_id", storeID)
+
+	visitFilter := bson.M{"visits.store_id": storeID}
+
+	timeRange := bson.M{}
+	if !from.IsZero() {
+		timeRange["$gte"] = from
+	}
+	if !to.IsZero() {
+		timeRange["$lt"] = to
+	}
+	if len(timeRange) > 0 {
+		visitFilter["visits.visit_time"] = timeRange
+	}
+
+	pipeline := mongo.Pipeline{
+		// uses the visits.store_id index to find the jobs first
+		{{Key: "$match", Value: bson.M{"visits.store_id": storeID}}},
+		{{Key: "$unwind", Value: "$visits"}},
+		{{Key: "$match", Value: visitFilter}},
+		{{Key: "$sort", Value: bson.D{{Key: "visits.visit_time", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.M{
+			"_id":         0,
+			"job_id":      "$_id",
+			"job_status":  "$status",
+			"visit_time":  "$visits.visit_time",
+			"image_urls":  "$visits.image_urls",
+			"image_uuids": "$visits.image_uuids",
+			"perimeters":  "$visits.perimeters",
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	visits = []StoreVisit{}
+	if err := cursor.All(ctx, &visits); err != nil {
+		return nil, err
+	}
+
+	return visits, nil
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/service"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source provides the store master records
+type Source interface {
+	// Name identifies the source in logs and load reports
+	Name() string
+	// Load reads every store, keyed by store ID, and reports rows that were skipped
+	Load(ctx context.Context) (map[string]model.Store, Report, error)
+	// Stamp cheaply identifies the current content, an empty stamp means the
+	// source can not tell and must always be reloaded
+	Stamp() (string, error)
+}
+
+// Issue kinds reported while parsing the store master
+const (
+	IssueDuplicateID = "duplicate_id"
+	IssueBlankID     = "blank_id"
+	IssueMalformed   = "malformed_row"
+)
+
+// Issue describes a row of the store master that was not loaded
+type Issue struct {
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	StoreID string `json:"store_id,omitempty"`
+	Message string `json:"message"`
+}
+
+// Report summarizes what was read from a source
+type Report struct {
+	Rows   int     `json:"rows"`
+	Loaded int     `json:"loaded"`
+	Issues []Issue `json:"issues"`
+}
+
+// CSVSource reads the store master from a CSV file
+type CSVSource struct {
+	Path string
+}
+
+func (cs *CSVSource) Name() string {
+	return "csv:" + cs.Path
+}
+
+func (cs *CSVSource) Load(ctx context.Context) (map[string]model.Store, Report, error) {
+	file, err := os.Open(cs.Path)
+	if err != nil {
+		return nil, Report{}, err
+	}
+	defer file.Close()
+
+	stores, report, err := ParseCSV(file)
+	if err != nil {
+		return nil, report, fmt.Errorf("%s: %w", cs.Path, err)
+	}
+
+	byID := make(map[string]model.Store, len(stores))
+	for _, st := range stores {
+		byID[st.ID] = st
+	}
+	return byID, report, nil
+}
+
+// Stamp is derived from the modification time and size of the file
+func (cs *CSVSource) Stamp() (string, error) {
+	stat, err := os.Stat(cs.Path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", stat.ModTime().UnixNano(), stat.Size()), nil
+}
+
+// MongoSource reads the store master from the stores collection
+type MongoSource struct {
+	Stores *service.StoresService
+}
+
+func (ms *MongoSource) Name() string {
+	return "mongo"
+}
+
+func (ms *MongoSource) Load(ctx context.Context) (map[string]model.Store, Report, error) {
+	stores, err := ms.Stores.ListStores(ctx)
+	if err != nil {
+		return nil, Report{}, err
+	}
+
+	byID := make(map[string]model.Store, len(stores))
+	for _, st := range stores {
+		byID[st.ID] = st
+	}
+
+	// the collection is keyed by store ID, so there is nothing to skip
+	return byID, Report{Rows: len(stores), Loaded: len(stores), Issues: []Issue{}}, nil
+}
+
+func (ms *MongoSource) Stamp() (string, error) {
+	return "", nil
+}
+
+// SeedFromCSV imports the CSV file at path into the stores collection of ss,
+// only if the collection is still empty. The file is only read then, it does
+// not have to exist otherwise. It returns the load report of the file, or nil
+// if the collection was not empty.
+func SeedFromCSV(ctx context.Context, ss *service.StoresService, path string) (*LoadInfo, error) {
+	count, err := ss.CountStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, nil
+	}
+
+	source := &CSVSource{Path: path}
+
+	stamp, err := source.Stamp()
+	if err != nil {
+		return nil, err
+	}
+
+	stores, report, err := source.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Store, 0, len(stores))
+	for _, st := range stores {
+		list = append(list, st)
+	}
+
+	if _, _, err := ss.UpsertStores(ctx, list); err != nil {
+		return nil, err
+	}
+
+	return &LoadInfo{
+		Source:   source.Name(),
+		Version:  1,
+		LoadedAt: time.Now().UTC(),
+		Stamp:    stamp,
+		Report:   report,
+	}, nil
+}
+
+// utf8BOM is written by some spreadsheet programs at the start of the file
+const utf8BOM = "\ufeff"
+
+// header names (normalized, see normalizeColumn) recognized for the known columns
+var (
+	idColumns       = []string{"storeid"}
+	nameColumns     = []string{"storename", "name"}
+	areaCodeColumns = []string{"areacode", "area"}
+)
+
+// ParseCSV reads store records from CSV data. Columns are matched by their
+// header name, unknown columns are kept in Store.Extra. Values are trimmed and a
+// leading byte order mark is ignored. Rows with a blank or duplicate store ID, or
+// with a different number of fields than the header, are skipped and reported.
+func ParseCSV(r io.Reader) ([]model.Store, Report, error) {
+	report := Report{Issues: []Issue{}}
+
+	// the mark has to go before parsing, csv.Reader rejects a quoted field
+	// that does not start with the quote
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		br.Discard(len(utf8BOM))
+	}
+
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1 // field counts are checked below to report every bad row
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, report, fmt.Errorf("csv is empty")
+	}
+	if err != nil {
+		return nil, report, err
+	}
+
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	idIdx := findColumn(header, idColumns)
+	if idIdx < 0 {
+		return nil, report, fmt.Errorf("csv has no StoreID column")
+	}
+	nameIdx := findColumn(header, nameColumns)
+	areaIdx := findColumn(header, areaCodeColumns)
+
+	stores := []model.Store{}
+
+	// line of the first occurrence of every store ID, to report duplicates
+	seen := make(map[string]int)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		report.Rows++
+
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, report, err
+			}
+			report.Issues = append(report.Issues, Issue{Line: parseErr.Line, Kind: IssueMalformed, Message: parseErr.Err.Error()})
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		if len(record) != len(header) {
+			report.Issues = append(report.Issues, Issue{
+				Line:    line,
+				Kind:    IssueMalformed,
+				Message: fmt.Sprintf("expected %d fields, found %d", len(header), len(record)),
+			})
+			continue
+		}
+
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		st := model.Store{ID: record[idIdx]}
+
+		if st.ID == "" {
+			report.Issues = append(report.Issues, Issue{Line: line, Kind: IssueBlankID, Message: "store ID is blank"})
+			continue
+		}
+
+		if first, ok := seen[st.ID]; ok {
+			report.Issues = append(report.Issues, Issue{
+				Line:    line,
+				Kind:    IssueDuplicateID,
+				StoreID: st.ID,
+				Message: fmt.Sprintf("store ID already defined on line %d", first),
+			})
+			continue
+		}
+		seen[st.ID] = line
+
+		for i, value := range record {
+			switch i {
+			case idIdx:
+			case nameIdx:
+				st.Name = value
+			case areaIdx:
+				st.AreaCode = value
+			default:
+				if st.Extra == nil {
+					st.Extra = make(map[string]string)
+				}
+				st.Extra[header[i]] = value
+			}
+		}
+
+		stores = append(stores, st)
+	}
+
+	report.Loaded = len(stores)
+	return stores, report, nil
+}
+
+// WriteCSV writes stores as CSV with a StoreID, StoreName and AreaCode header
+// followed by the union of all extra columns
+func WriteCSV(w io.Writer, stores []model.Store) error {
+	extraSet := make(map[string]struct{})
+	for _, st := range stores {
+		for column := range st.Extra {
+			extraSet[column] = struct{}{}
+		}
+	}
+
+	extra := make([]string, 0, len(extraSet))
+	for column := range extraSet {
+		extra = append(extra, column)
+	}
+	sort.Strings(extra)
+
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(append([]string{"StoreID", "StoreName", "AreaCode"}, extra...)); err != nil {
+		return err
+	}
+
+	for _, st := range stores {
+		record := []string{st.ID, st.Name, st.AreaCode}
+		for _, column := range extra {
+			record = append(record, st.Extra[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// findColumn returns the index of the first header matching one of names, or -1
+func findColumn(header []string, names []string) int {
+	for i, column := range header {
+		normalized := normalizeColumn(column)
+		for _, name := range names {
+			if normalized == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// normalizeColumn lower cases a header and drops separators so that
+// "StoreID", "store_id" and "Store Id" all match
+func normalizeColumn(column string) string {
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(column)))
+}
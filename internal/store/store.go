@@ -1,66 +1,162 @@
 package store
 
 import (
-	"encoding/csv"
+	"context"
 	"image-job-processor/internal/logger"
-	"os"
+	"image-job-processor/internal/model"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// StoreManager manages the store IDs
+// StoreManager keeps an in-memory cache of the store master loaded from a Source.
+// The loaded set is swapped atomically on reload, so lookups never block.
 type StoreManager struct {
-	storeIDs map[string]struct{}
+	source   Source
+	log      *logger.Logger
+	current  atomic.Pointer[storeSet]
+	reloadMu sync.Mutex
+	// lastErr is the error of the last reload, nil if it succeeded
+	lastErr error
 }
 
-var (
-	instance *StoreManager
-	once     sync.Once
-)
+// storeSet is an immutable snapshot of the store master
+type storeSet struct {
+	stores map[string]model.Store
+	info   LoadInfo
+}
 
-var CsvFilePath string = "StoreMasterAssignment.csv"
+// LoadInfo describes the currently loaded version of the store master
+type LoadInfo struct {
+	Source   string    `json:"source"`
+	Version  int64     `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Stamp    string    `json:"stamp,omitempty"`
+	Report
+}
 
-// NewStoreManager creates a new instance of StoreManager and loads store IDs from a CSV file
-func NewStoreManager() (*StoreManager, error) {
-	var err error
-	once.Do(func() {
-		instance = &StoreManager{
-			storeIDs: make(map[string]struct{}),
-		}
-		err = instance.loadStoreIDs(CsvFilePath)
+// NewStoreManager creates a StoreManager and loads the stores from source.
+// The manager is returned even if the load fails, with no stores, so that a
+// later Reload or Watch can still pick them up.
+func NewStoreManager(ctx context.Context, source Source, log *logger.Logger) (*StoreManager, error) {
+	sm := &StoreManager{
+		source: source,
+		log:    log,
+	}
+	sm.current.Store(&storeSet{
+		stores: make(map[string]model.Store),
+		info:   LoadInfo{Source: source.Name()},
 	})
 
-	return instance, err
+	_, err := sm.Reload(ctx)
+	return sm, err
+}
+
+// Source returns where the stores are loaded from
+func (sm *StoreManager) Source() Source {
+	return sm.source
 }
 
-// loadStoreIDs loads store IDs from a CSV file into the map
-func (sm *StoreManager) loadStoreIDs(filePath string) error {
-	file, err := os.Open(filePath)
+// Reload loads the stores from the source again and swaps in the new set.
+// On error the previously loaded set is kept.
+func (sm *StoreManager) Reload(ctx context.Context) (info LoadInfo, err error) {
+	sm.reloadMu.Lock()
+	defer sm.reloadMu.Unlock()
+
+	defer func() { sm.lastErr = err }()
+
+	stamp, err := sm.source.Stamp()
 	if err != nil {
-		return err
+		return sm.Info(), err
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	stores, report, err := sm.source.Load(ctx)
 	if err != nil {
-		return err
+		return sm.Info(), err
+	}
+
+	set := &storeSet{
+		stores: stores,
+		info: LoadInfo{
+			Source:   sm.source.Name(),
+			Version:  sm.Info().Version + 1,
+			LoadedAt: time.Now().UTC(),
+			Stamp:    stamp,
+			Report:   report,
+		},
+	}
+	sm.current.Store(set)
+
+	sm.log.Info("Loaded store master", "version", set.info.Version, "stores", set.info.Loaded, "source", set.info.Source)
+	for _, issue := range report.Issues {
+		sm.log.Warn("Skipped store master line", "line", issue.Line, "kind", issue.Kind, "message", issue.Message)
 	}
+	return set.info, nil
+}
 
-	// Check if there are records and skip the header
-	if len(records) > 0 {
-		for _, record := range records[1:] { // Start from the second record to skip the header
-			if len(record) > 2 { // Ensure there are enough columns
-				storeID := record[2] // StoreID is in the third column (index 2)
-				sm.storeIDs[storeID] = struct{}{}
+// LastError returns the error of the last reload, or nil if it succeeded
+func (sm *StoreManager) LastError() error {
+	sm.reloadMu.Lock()
+	defer sm.reloadMu.Unlock()
+
+	return sm.lastErr
+}
+
+// Info returns details about the currently loaded store master
+func (sm *StoreManager) Info() LoadInfo {
+	return sm.current.Load().info
+}
+
+// Watch checks the source every interval and reloads it when its stamp changes.
+// Sources without a stamp are reloaded on every tick. It returns when ctx is done.
+func (sm *StoreManager) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamp, err := sm.source.Stamp()
+			if err != nil {
+				sm.log.Error("Failed to check store master", "source", sm.source.Name(), "error", err)
+				continue
+			}
+
+			if stamp != "" && stamp == sm.Info().Stamp {
+				continue
+			}
+
+			if _, err := sm.Reload(ctx); err != nil {
+				sm.log.Error("Failed to reload store master", "source", sm.source.Name(), "error", err)
 			}
 		}
 	}
-	logger.GetLogger().Log("CSV read finished")
-	return nil
 }
 
 // StoreIDExists checks if a store ID exists in the map
 func (sm *StoreManager) StoreIDExists(storeID string) bool {
-	_, exists := sm.storeIDs[storeID]
+	_, exists := sm.current.Load().stores[storeID]
 	return exists
 }
+
+// GetStore returns the store record for storeID
+func (sm *StoreManager) GetStore(storeID string) (model.Store, bool) {
+	st, exists := sm.current.Load().stores[storeID]
+	return st, exists
+}
+
+// Stores returns all store records sorted by store ID
+func (sm *StoreManager) Stores() []model.Store {
+	set := sm.current.Load()
+
+	stores := make([]model.Store, 0, len(set.stores))
+	for _, st := range set.stores {
+		stores = append(stores, st)
+	}
+
+	sort.Slice(stores, func(i, j int) bool { return stores[i].ID < stores[j].ID })
+	return stores
+}
@@ -0,0 +1,245 @@
+package urlpolicy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kinds of the errors returned by a Policy, to be told apart with errors.Is
+var (
+	ErrScheme    = errors.New("scheme not allowed")
+	ErrHost      = errors.New("host not allowed")
+	ErrAddress   = errors.New("address not allowed")
+	ErrRedirects = errors.New("too many redirects")
+)
+
+// Error tells why a URL or an address is not allowed, it unwraps to one of
+// the kinds above
+type Error struct {
+	kind    error
+	message string
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// Settings configure a Policy
+type Settings struct {
+	// Schemes allowed, http and https when empty
+	Schemes []string
+	// AllowPrivateNetworks allows loopback, private and shared addresses, e.g.
+	// for an image server inside the cluster. Link-local addresses, where the
+	// cloud metadata services live, stay blocked.
+	AllowPrivateNetworks bool
+	// AllowedHosts, when not empty, are the only hosts allowed. A pattern is
+	// either a host name or *.domain, matching every subdomain of domain.
+	AllowedHosts []string
+	// DeniedHosts are never allowed, even when they match AllowedHosts
+	DeniedHosts []string
+	// MaxRedirects is the number of redirects followed, 0 follows none
+	MaxRedirects int
+}
+
+// Policy decides which URLs may be fetched. URLs are checked when submitted
+// and the addresses their hosts resolve to when connecting, so that host
+// names resolving to a blocked address and redirects are caught as well.
+type Policy struct {
+	schemes      []string
+	allowPrivate bool
+	allowedHosts []string
+	deniedHosts  []string
+	maxRedirects int
+}
+
+// New creates a Policy from settings
+func New(settings Settings) *Policy {
+	p := &Policy{
+		schemes:      lowerAll(settings.Schemes),
+		allowPrivate: settings.AllowPrivateNetworks,
+		allowedHosts: lowerAll(settings.AllowedHosts),
+		deniedHosts:  lowerAll(settings.DeniedHosts),
+		maxRedirects: max(0, settings.MaxRedirects),
+	}
+
+	if len(p.schemes) == 0 {
+		p.schemes = []string{"http", "https"}
+	}
+
+	return p
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			lowered = append(lowered, v)
+		}
+	}
+	return lowered
+}
+
+// CheckURL checks the scheme and the host of u, and the address of the host
+// when it is an IP address. Host names are only resolved when connecting.
+func (p *Policy) CheckURL(u *url.URL) error {
+	if !slices.Contains(p.schemes, strings.ToLower(u.Scheme)) {
+		return &Error{
+			kind:    ErrScheme,
+			message: fmt.Sprintf("scheme %q is not allowed, use %s", u.Scheme, strings.Join(p.schemes, " or ")),
+		}
+	}
+
+	// a trailing dot names the same host, it must not get around the lists
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	if host == "" {
+		return &Error{kind: ErrHost, message: "the url has no host"}
+	}
+
+	if matchHost(p.deniedHosts, host) || (len(p.allowedHosts) > 0 && !matchHost(p.allowedHosts, host)) {
+		return &Error{kind: ErrHost, message: fmt.Sprintf("host %s is not allowed", host)}
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.CheckAddr(addr)
+	}
+
+	return nil
+}
+
+// matchHost tells whether host matches one of patterns
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// nat64Prefix embeds IPv4 addresses in IPv6 ones, the embedded address is checked
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// reservedPrefixes are never reachable on purpose
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// sharedPrefixes are not routed on the internet, like the private networks
+var sharedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+}
+
+// CheckAddr checks an address a URL resolves to
+func (p *Policy) CheckAddr(addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+
+	var reason string
+
+	switch {
+	case addr.IsUnspecified() || inPrefixes(reservedPrefixes, addr):
+		reason = "reserved"
+	case addr.IsLinkLocalUnicast():
+		reason = "link-local"
+	case addr.IsMulticast():
+		reason = "multicast"
+	case p.allowPrivate:
+		return nil
+	case addr.IsLoopback():
+		reason = "loopback"
+	case addr.IsPrivate() || inPrefixes(sharedPrefixes, addr):
+		reason = "private"
+	default:
+		return nil
+	}
+
+	return &Error{kind: ErrAddress, message: fmt.Sprintf("address %s is not allowed, it is %s", addr, reason)}
+}
+
+func inPrefixes(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns an HTTP client enforcing p: every request and redirect is
+// checked with CheckURL, every connection with CheckAddr once the host is
+// resolved, and at most MaxRedirects redirects are followed. Proxies are not
+// used, the addresses they connect to could not be checked.
+func (p *Policy) Client() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   p.control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: &checkedTransport{policy: p, next: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// via holds the original request and the redirects followed so far
+			if len(via) > p.maxRedirects {
+				return &Error{kind: ErrRedirects, message: fmt.Sprintf("stopped after %d redirects", p.maxRedirects)}
+			}
+			return nil
+		},
+	}
+}
+
+// control runs once the address to connect to is resolved, before connecting
+func (p *Policy) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &Error{kind: ErrAddress, message: fmt.Sprintf("address %s can not be checked", address)}
+	}
+
+	return p.CheckAddr(addrPort.Addr())
+}
+
+// checkedTransport checks the URL of every request, redirects included,
+// before sending it
+type checkedTransport struct {
+	policy *Policy
+	next   http.RoundTripper
+}
+
+func (t *checkedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.CheckURL(req.URL); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	return t.next.RoundTrip(req)
+}
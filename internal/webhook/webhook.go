@@ -0,0 +1,235 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image-job-processor/internal/logger"
+	"image-job-processor/internal/model"
+	"image-job-processor/internal/service"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the request body
+const SignatureHeader = "X-Signature-256"
+
+// Settings of the callback deliveries
+type Settings struct {
+	// Secret signs the callback payloads, nothing is delivered without it
+	Secret string
+	// MaxAttempts is the number of deliveries tried before giving up
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled after every attempt
+	InitialBackoff time.Duration
+	// Timeout bounds a single delivery
+	Timeout time.Duration
+	// Client posts the callbacks, http.DefaultClient when nil. The callback
+	// URLs come from the clients, it should enforce the URL policy.
+	Client *http.Client
+}
+
+// Deliverer posts the callbacks of finished jobs and records every attempt on the job
+type Deliverer struct {
+	jobs     service.JobRepository
+	settings Settings
+
+	// ctx is cancelled when the shutdown deadline passes, interrupting the
+	// deliveries still running
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// NewDeliverer creates a Deliverer recording the attempts in jobs
+func NewDeliverer(jobs service.JobRepository, settings Settings) *Deliverer {
+	if settings.Client == nil {
+		settings.Client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Deliverer{jobs: jobs, settings: settings, ctx: ctx, cancel: cancel}
+}
+
+// Send delivers the payload in the background, see Deliver. Shutdown waits for
+// the deliveries started by Send.
+func (d *Deliverer) Send(ctx context.Context, id primitive.ObjectID, url string, payload Payload) {
+	d.running.Add(1)
+
+	go func() {
+		defer d.running.Done()
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(d.ctx, cancel)
+		defer stop()
+
+		d.Deliver(ctx, id, url, payload)
+	}()
+}
+
+// Shutdown waits for the deliveries started by Send until ctx is done. The
+// deliveries still running then are interrupted, it returns ctx.Err() once
+// they have stopped.
+func (d *Deliverer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// ErrorInfo describes why a job failed
+type ErrorInfo struct {
+	StoreID string `json:"store_id"`
+	Error   string `json:"error"`
+}
+
+// Summary gives a short overview of the work done by a job
+type Summary struct {
+	Visits          int `json:"visits"`
+	ImagesTotal     int `json:"images_total"`
+	ImagesProcessed int `json:"images_processed"`
+}
+
+// Payload is the JSON body posted to the callback URL
+type Payload struct {
+	JobID     string     `json:"job_id"`
+	Status    string     `json:"status"`
+	Error     *ErrorInfo `json:"error,omitempty"`
+	Summary   Summary    `json:"summary"`
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// NewPayload builds the callback payload for a job that reached a terminal state
+func NewPayload(id primitive.ObjectID, sv *model.StoresVisit) Payload {
+	p := Payload{
+		JobID:     id.Hex(),
+		Status:    sv.Status,
+		Summary:   Summary{Visits: len(sv.Visits)},
+		Timestamp: time.Now().UTC(),
+	}
+
+	for _, v := range sv.Visits {
+		p.Summary.ImagesTotal += len(v.ImageURLs)
+		p.Summary.ImagesProcessed += len(v.ImageUUIDs)
+	}
+
+	if sv.Status == "failed" {
+		p.Error = &ErrorInfo{StoreID: sv.FailedStoreID, Error: sv.Error}
+	}
+
+	return p
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body using secret
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver posts the payload to url, retrying with exponential backoff until
+// ctx is done. Every attempt is recorded on the job. Messages are logged with
+// the logger carried by ctx.
+func (d *Deliverer) Deliver(ctx context.Context, id primitive.ObjectID, url string, payload Payload) {
+	log := logger.FromContext(ctx).With("url", url)
+
+	// anyone could sign a payload with an empty secret
+	if d.settings.Secret == "" {
+		log.Error("Not delivering callback, no webhook secret is set to sign it")
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Error("Failed to encode callback payload", "error", err)
+		return
+	}
+
+	signature := "sha256=" + Sign([]byte(d.settings.Secret), body)
+
+	backoff := d.settings.InitialBackoff
+
+	for attempt := 1; attempt <= d.settings.MaxAttempts; attempt++ {
+		start := time.Now()
+		statusCode, err := d.post(ctx, url, body, signature)
+
+		record := model.CallbackAttempt{
+			Attempt:    attempt,
+			Time:       time.Now().UTC(),
+			StatusCode: statusCode,
+			Delivered:  err == nil,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		// an attempt cut short by ctx is recorded as well
+		if err := d.jobs.AppendCallbackAttempt(context.WithoutCancel(ctx), id, record); err != nil {
+			log.Error("Failed to record callback attempt", "attempt", attempt, "error", err)
+		}
+
+		if err == nil {
+			log.Info("Delivered callback", "attempt", attempt, "status_code", statusCode, "duration", time.Since(start))
+			return
+		}
+
+		log.Warn("Callback attempt failed", "attempt", attempt, "status_code", statusCode, "duration", time.Since(start), "error", err)
+
+		if attempt < d.settings.MaxAttempts {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				log.Error("Abandoned callback, it was interrupted", "attempts", attempt, "error", ctx.Err())
+				return
+			}
+			backoff *= 2
+		}
+	}
+
+	log.Error("Giving up on callback", "attempts", d.settings.MaxAttempts)
+}
+
+// post sends a single signed delivery and treats any non 2xx response as a failure
+func (d *Deliverer) post(ctx context.Context, url string, body []byte, signature string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.settings.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := d.settings.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}